@@ -0,0 +1,258 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Backblaze/blazer/base"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	b2AuthorizeAccountPath = "/b2api/v3/b2_authorize_account"
+	b2ListBucketsPath      = "/b2api/v3/b2_list_buckets"
+
+	// v4 is the first version to allow keys restricted to more
+	// than one bucket
+	b2CreateKeyPath = "/b2api/v4/b2_create_key"
+)
+
+// b2AccountInfo holds the parts of the b2_authorize_account response
+// which blazer does not expose
+type b2AccountInfo struct {
+	AccountId string
+	ApiUrl    string
+
+	// AuthorizationToken authorizes further API calls
+	AuthorizationToken string
+
+	S3ApiUrl    string
+	DownloadUrl string
+
+	// Capabilities, BucketId, BucketName and NamePrefix describe the
+	// restrictions on the application key that was authorized
+	Capabilities []string
+	BucketId     string
+	BucketName   string
+	NamePrefix   string
+
+	// KeyExpiration is zero if the application key never expires
+	KeyExpiration time.Time
+}
+
+type b2AuthorizeAccountResponse struct {
+	AccountId          string `json:"accountId"`
+	AuthorizationToken string `json:"authorizationToken"`
+	KeyExpiration      *int64 `json:"applicationKeyExpirationTimestamp"`
+	ApiInfo            struct {
+		StorageApi struct {
+			ApiUrl       string   `json:"apiUrl"`
+			S3ApiUrl     string   `json:"s3ApiUrl"`
+			DownloadUrl  string   `json:"downloadUrl"`
+			Capabilities []string `json:"capabilities"`
+			BucketId     string   `json:"bucketId"`
+			BucketName   string   `json:"bucketName"`
+			NamePrefix   string   `json:"namePrefix"`
+		} `json:"storageApi"`
+	} `json:"apiInfo"`
+}
+
+type b2CreateKeyRequest struct {
+	AccountId              string   `json:"accountId"`
+	Capabilities           []string `json:"capabilities"`
+	KeyName                string   `json:"keyName"`
+	ValidDurationInSeconds int64    `json:"validDurationInSeconds,omitempty"`
+	BucketIds              []string `json:"bucketIds,omitempty"`
+	NamePrefix             string   `json:"namePrefix,omitempty"`
+}
+
+type b2CreateKeyResponse struct {
+	ApplicationKeyId    string   `json:"applicationKeyId"`
+	ApplicationKey      string   `json:"applicationKey"`
+	KeyName             string   `json:"keyName"`
+	Capabilities        []string `json:"capabilities"`
+	AccountId           string   `json:"accountId"`
+	BucketIds           []string `json:"bucketIds"`
+	NamePrefix          string   `json:"namePrefix"`
+	ExpirationTimestamp *int64   `json:"expirationTimestamp"`
+}
+
+type b2ListBucketsRequest struct {
+	AccountId  string `json:"accountId"`
+	BucketName string `json:"bucketName,omitempty"`
+}
+
+type b2ListBucketsResponse struct {
+	Buckets []struct {
+		BucketId   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"buckets"`
+}
+
+type b2ErrorResponse struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// authorizeAccount calls b2_authorize_account directly to find out what
+// the given application key is allowed to do
+func authorizeAccount(ctx context.Context, httpClient *http.Client, apiBase string, applicationKeyId string, applicationKey string) (*b2AccountInfo, error) {
+	if apiBase == "" {
+		apiBase = base.APIBase
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiBase+b2AuthorizeAccountPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(applicationKeyId, applicationKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error authorizing account: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var b2Err b2ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&b2Err); err != nil || b2Err.Code == "" {
+			return nil, fmt.Errorf("error authorizing account: unexpected status %d", resp.StatusCode)
+		}
+		return nil, fmt.Errorf("error authorizing account: %s (%d %s)", b2Err.Message, b2Err.Status, b2Err.Code)
+	}
+
+	var authResp b2AuthorizeAccountResponse
+	if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
+		return nil, fmt.Errorf("error decoding authorize account response: %w", err)
+	}
+
+	storage := authResp.ApiInfo.StorageApi
+	info := &b2AccountInfo{
+		AccountId:          authResp.AccountId,
+		AuthorizationToken: authResp.AuthorizationToken,
+		ApiUrl:             storage.ApiUrl,
+		S3ApiUrl:           storage.S3ApiUrl,
+		DownloadUrl:        storage.DownloadUrl,
+		Capabilities:       storage.Capabilities,
+		BucketId:           storage.BucketId,
+		BucketName:         storage.BucketName,
+		NamePrefix:         storage.NamePrefix,
+	}
+
+	if authResp.KeyExpiration != nil {
+		info.KeyExpiration = time.UnixMilli(*authResp.KeyExpiration)
+	}
+
+	return info, nil
+}
+
+// getAccountInfo authorizes the mount's configured application key and
+// returns what B2 reports about it
+func (b *backblazeB2Backend) getAccountInfo(ctx context.Context, c *backblazeB2Config) (*b2AccountInfo, error) {
+	transport, err := c.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	defer transport.CloseIdleConnections()
+
+	return authorizeAccount(ctx, &http.Client{Transport: transport, Timeout: c.RequestTimeout}, c.ApiUrl, c.ApplicationKeyId, c.ApplicationKey)
+}
+
+// getConnectionAccount returns the account details of a connection, such
+// as its API endpoints. The result is cached until the client is reset.
+func (b *backblazeB2Backend) getConnectionAccount(ctx context.Context, connection string, client b2API) (*b2AccountInfo, error) {
+	b.lock.RLock()
+	info := b.accounts[connection]
+	b.lock.RUnlock()
+
+	if info != nil {
+		return info, nil
+	}
+
+	info, err := client.AccountInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	b.lock.Lock()
+	b.accounts[connection] = info
+	b.lock.Unlock()
+
+	return info, nil
+}
+
+// s3Region returns the region of a B2 S3 endpoint, such as us-west-004
+// for https://s3.us-west-004.backblazeb2.com
+func s3Region(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+
+	labels := strings.Split(u.Hostname(), ".")
+	if len(labels) < 3 || labels[0] != "s3" {
+		return ""
+	}
+
+	return labels[1]
+}
+
+// rootKeyMetadata describes the mount's root application key
+type rootKeyMetadata struct {
+	ApplicationKeyId string
+	Name             string
+
+	*b2AccountInfo
+}
+
+// getRootKeyMetadata returns what B2 reports about a connection's
+// application key. The result is cached until the client is reset.
+func (b *backblazeB2Backend) getRootKeyMetadata(ctx context.Context, s logical.Storage, name string, c *backblazeB2Config) (*rootKeyMetadata, error) {
+	b.lock.RLock()
+	metadata := b.rootKeys[name]
+	b.lock.RUnlock()
+
+	if metadata != nil && metadata.ApplicationKeyId == c.ApplicationKeyId {
+		return metadata, nil
+	}
+
+	// Authorize directly first, as it fails fast where blazer would
+	// keep retrying an unreachable API
+	info, err := b.getAccountInfo(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := b.getConnectionClient(ctx, s, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only ListKeys knows the key's name
+	key, err := client.GetKey(ctx, c.ApplicationKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("cannot find key %q in b2", c.ApplicationKeyId)
+	}
+
+	metadata = &rootKeyMetadata{
+		ApplicationKeyId: c.ApplicationKeyId,
+		Name:             key.Name,
+		b2AccountInfo:    info,
+	}
+
+	b.lock.Lock()
+	b.rootKeys[name] = metadata
+	b.lock.Unlock()
+
+	return metadata, nil
+}
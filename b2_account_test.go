@@ -0,0 +1,71 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizeAccount(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != b2AuthorizeAccountPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != applicationKeyID || secret != applicationKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"status": 401, "code": "unauthorized", "message": "bad key"}`))
+			return
+		}
+
+		_, _ = w.Write([]byte(`{
+			"accountId": "account-1",
+			"applicationKeyExpirationTimestamp": 1700000000000,
+			"authorizationToken": "token",
+			"apiInfo": {
+				"storageApi": {
+					"apiUrl": "https://api001.example.com",
+					"s3ApiUrl": "https://s3.us-west-001.example.com",
+					"downloadUrl": "https://f001.example.com",
+					"capabilities": ["listKeys", "writeKeys", "deleteKeys", "listBuckets"],
+					"bucketId": "bucket-1",
+					"bucketName": "my-bucket",
+					"namePrefix": "logs/"
+				}
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	t.Run("Authorize - pass", func(t *testing.T) {
+		info, err := authorizeAccount(context.Background(), server.Client(), server.URL, applicationKeyID, applicationKey)
+		require.NoError(t, err)
+		require.Equal(t, "account-1", info.AccountId)
+		require.Equal(t, "https://api001.example.com", info.ApiUrl)
+		require.Equal(t, "https://s3.us-west-001.example.com", info.S3ApiUrl)
+		require.Equal(t, "https://f001.example.com", info.DownloadUrl)
+		require.Equal(t, []string{"listKeys", "writeKeys", "deleteKeys", "listBuckets"}, info.Capabilities)
+		require.Equal(t, "bucket-1", info.BucketId)
+		require.Equal(t, "my-bucket", info.BucketName)
+		require.Equal(t, "logs/", info.NamePrefix)
+		require.Equal(t, time.UnixMilli(1700000000000), info.KeyExpiration)
+	})
+
+	t.Run("Authorize - bad key", func(t *testing.T) {
+		_, err := authorizeAccount(context.Background(), server.Client(), server.URL, applicationKeyID, "wrong")
+		require.ErrorContains(t, err, "unauthorized")
+	})
+}
+
+func TestS3Region(t *testing.T) {
+	require.Equal(t, "us-west-004", s3Region("https://s3.us-west-004.backblazeb2.com"))
+	require.Equal(t, "eu-central-003", s3Region("https://s3.eu-central-003.backblazeb2.com/"))
+	require.Empty(t, s3Region("http://127.0.0.1:8080"))
+	require.Empty(t, s3Region(""))
+}
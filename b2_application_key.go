@@ -4,14 +4,66 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 
-	b2client "github.com/Backblaze/blazer/b2"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const b2KeyType = "b2_application_key"
 
+const issuedKeyStoragePrefix = "issued-keys/"
+
+// issuedKey records an application key this mount holds a lease for and
+// who asked for it. Tidy uses the records to tell keys still in use from
+// ones left behind.
+type issuedKey struct {
+	Role       string    `json:"role"`
+	Connection string    `json:"connection"`
+	KeyName    string    `json:"key_name"`
+	CreateTime time.Time `json:"create_time"`
+
+	// EntityID and DisplayName describe the token which asked for
+	// the key
+	EntityID    string `json:"entity_id"`
+	DisplayName string `json:"display_name"`
+
+	// LeaseID is only known once the lease is first renewed, as Vault
+	// creates it after the key is issued
+	LeaseID string `json:"lease_id"`
+
+	// ExpireTime is the latest the lease can expire, after which the
+	// record no longer keeps tidy from deleting the key. Records from
+	// before it was kept have none until the lease is next renewed.
+	ExpireTime time.Time `json:"expire_time"`
+}
+
+// expired reports whether the key's lease can no longer be live at now
+func (k *issuedKey) expired(now time.Time) bool {
+	return !k.ExpireTime.IsZero() && !now.Before(k.ExpireTime)
+}
+
+// leaseExpireTime returns the latest a lease issued at issueTime can
+// expire. Vault holds it to maxTTL, or to the mount's max TTL when that is
+// unset or lower, and the key expiring in B2 ends it too.
+func (b *backblazeB2Backend) leaseExpireTime(issueTime time.Time, maxTTL time.Duration, keyExpires time.Time) time.Time {
+	if mountMax := b.System().MaxLeaseTTL(); maxTTL <= 0 || (mountMax > 0 && mountMax < maxTTL) {
+		maxTTL = mountMax
+	}
+
+	var expireTime time.Time
+	if maxTTL > 0 {
+		expireTime = issueTime.Add(maxTTL)
+	}
+
+	if !keyExpires.IsZero() && (expireTime.IsZero() || keyExpires.Before(expireTime)) {
+		expireTime = keyExpires
+	}
+
+	return expireTime
+}
+
 func (b *backblazeB2Backend) b2ApplicationsKey() *framework.Secret {
 	return &framework.Secret{
 		Type: b2KeyType,
@@ -31,50 +83,55 @@ func (b *backblazeB2Backend) b2ApplicationsKey() *framework.Secret {
 }
 
 func (b *backblazeB2Backend) b2ApplicationKeyCreate(ctx context.Context, s logical.Storage,
-	keyName string, role backblazeB2RoleEntry) (*b2client.Key, error) {
+	keyName string, role backblazeB2RoleEntry) (*b2Key, error) {
 
-	client, err := b.getB2Client(ctx, s)
+	client, err := b.getConnectionClient(ctx, s, role.Connection)
 	if err != nil {
 		return nil, err
 	}
 
-	// Set key options
-	var keyOpts []b2client.KeyOption
-
-	// Set capabilities
-	keyOpts = append(keyOpts, b2client.Capabilities(role.Capabilities...))
-
-	// If bucketName is set, look up the bucket and create that way.
-	// Else, create the key directly. This is how Blazer does it.
-	if role.BucketName != "" {
-		bucket, err := client.Bucket(ctx, role.BucketName)
+	// B2 restricts keys by bucket ID, but roles may name their buckets
+	bucketIDs := slices.Clone(role.BucketIDs)
+	for _, bucketName := range role.BucketNames {
+		bucketID, err := b.bucketID(ctx, role.Connection, client, bucketName)
 		if err != nil {
 			return nil, err
 		}
-		// Set prefix if asked for
-		if role.NamePrefix != "" {
-			keyOpts = append(keyOpts, b2client.Prefix(role.NamePrefix))
-		}
 
-		newKey, err := bucket.CreateKey(ctx, keyName, keyOpts...)
-		if err != nil {
-			return nil, err
+		if !slices.Contains(bucketIDs, bucketID) {
+			bucketIDs = append(bucketIDs, bucketID)
 		}
-		return newKey, nil
+	}
 
-	} else {
-		newKey, err := client.CreateKey(ctx, keyName, keyOpts...)
-		if err != nil {
-			return nil, err
-		}
-		return newKey, nil
+	key, err := client.CreateKey(ctx, keyName, b2KeyOptions{
+		Capabilities: role.Capabilities,
+		BucketIDs:    bucketIDs,
+		NamePrefix:   role.NamePrefix,
+		Lifetime:     role.keyLifetime(),
+	})
+	if err != nil {
+		// A bucket may have been deleted and created again with
+		// the same name since its ID was cached
+		b.forgetBucketIDs(role.Connection, role.BucketNames)
+		return nil, err
 	}
 
+	return key, nil
 }
 
 func (b *backblazeB2Backend) b2ApplicationKeyRevoke(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
 
-	client, err := b.getB2Client(ctx, req.Storage)
+	// Keys issued before connections existed were all created with
+	// the default config
+	connection := defaultConnectionName
+	if connectionRaw, ok := req.Secret.InternalData["connection"]; ok {
+		connection, ok = connectionRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("internal connection is not a string")
+		}
+	}
+
+	client, err := b.getConnectionClient(ctx, req.Storage, connection)
 	if err != nil {
 		return nil, err
 	}
@@ -91,27 +148,15 @@ func (b *backblazeB2Backend) b2ApplicationKeyRevoke(ctx context.Context, req *lo
 		return nil, fmt.Errorf("internal application_key_id is not a string")
 	}
 
-	// Find key
-	var applicationKey *b2client.Key
-	keys, _, err := client.ListKeys(ctx, 1, applicationKeyId)
-	if err != nil {
+	// The key may have been deleted outside of Vault, which DeleteKey
+	// doesn't treat as an error. Either way it's gone, so the lease is
+	// released rather than retried.
+	if err := client.DeleteKey(ctx, applicationKeyId); err != nil {
 		return nil, err
 	}
 
-	// We should only get one, but verify
-	for _, key := range keys {
-		if key.ID() == applicationKeyId {
-			applicationKey = key
-			break
-		}
-	}
-
-	if applicationKey == nil {
-		return nil, fmt.Errorf("cannot find key in b2")
-	}
-
-	if err := applicationKey.Delete(ctx); err != nil {
-		return nil, err
+	if err := req.Storage.Delete(ctx, issuedKeyStoragePrefix+applicationKeyId); err != nil {
+		return nil, fmt.Errorf("error deleting issued key record: %w", err)
 	}
 
 	return nil, nil
@@ -139,9 +184,69 @@ func (b *backblazeB2Backend) b2ApplicationKeyRenew(ctx context.Context, req *log
 	if roleEntry.TTL > 0 {
 		resp.Secret.TTL = roleEntry.TTL
 	}
+
+	// Keep to the TTL asked for when the key was issued
+	if ttlRaw, ok := req.Secret.InternalData["ttl"]; ok {
+		ttlStr, ok := ttlRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("internal ttl is not a string")
+		}
+
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing internal ttl: %w", err)
+		}
+
+		resp.Secret.TTL = ttl
+	}
 	if roleEntry.MaxTTL > 0 {
 		resp.Secret.MaxTTL = roleEntry.MaxTTL
 	}
 
+	// Never let the lease outlive the key in B2, even if the role's
+	// max_ttl has been raised since it was issued
+	if expirationRaw, ok := req.Secret.InternalData["expiration"]; ok {
+		expirationStr, ok := expirationRaw.(string)
+		if !ok {
+			return nil, fmt.Errorf("internal expiration is not a string")
+		}
+
+		expiration, err := time.Parse(time.RFC3339, expirationStr)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing internal expiration: %w", err)
+		}
+
+		if !time.Now().Before(expiration) {
+			return nil, errors.New("application key has expired in b2")
+		}
+
+		limit := expiration.Sub(req.Secret.IssueTime)
+		if resp.Secret.MaxTTL <= 0 || limit < resp.Secret.MaxTTL {
+			resp.Secret.MaxTTL = limit
+		}
+	}
+
+	// Raising the role's max_ttl lets the lease live longer
+	var expireTime time.Time
+	if !req.Secret.IssueTime.IsZero() {
+		expireTime = b.leaseExpireTime(req.Secret.IssueTime, resp.Secret.MaxTTL, time.Time{})
+	}
+	if err := b.updateIssuedKeyOnRenew(ctx, req, role, expireTime); err != nil {
+		return nil, err
+	}
+
 	return resp, nil
 }
+
+func (b *backblazeB2Backend) saveIssuedKey(ctx context.Context, s logical.Storage, applicationKeyId string, key *issuedKey) error {
+	entry, err := logical.StorageEntryJSON(issuedKeyStoragePrefix+applicationKeyId, key)
+	if err != nil {
+		return fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("error saving issued key record: %w", err)
+	}
+
+	return nil
+}
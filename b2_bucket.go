@@ -0,0 +1,77 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"time"
+)
+
+// bucketIDCacheTTL is how long a bucket's ID is used before it is looked
+// up again. A bucket's ID never changes, but a bucket can be deleted and
+// another created with the same name.
+const bucketIDCacheTTL = 10 * time.Minute
+
+type cachedBucketID struct {
+	id      string
+	expires time.Time
+}
+
+// bucketID returns the ID of a bucket in a connection's account, looking
+// it up with client unless it is cached
+func (b *backblazeB2Backend) bucketID(ctx context.Context, connection string, client b2API, name string) (string, error) {
+	b.lock.RLock()
+	cached, ok := b.bucketIDs[connection][name]
+	b.lock.RUnlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	id, err := client.BucketID(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.bucketIDs[connection] == nil {
+		b.bucketIDs[connection] = make(map[string]cachedBucketID)
+	}
+
+	b.bucketIDs[connection][name] = cachedBucketID{
+		id:      id,
+		expires: time.Now().Add(bucketIDCacheTTL),
+	}
+
+	return id, nil
+}
+
+// forgetBucketIDs drops the cached IDs of buckets in a connection's account
+func (b *backblazeB2Backend) forgetBucketIDs(connection string, names []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, name := range names {
+		delete(b.bucketIDs[connection], name)
+	}
+}
+
+// cachedBucketNames returns the names of the buckets with the given IDs in
+// a connection's account, as cached when their IDs were looked up. The
+// name of a bucket whose ID wasn't looked up is left empty.
+func (b *backblazeB2Backend) cachedBucketNames(connection string, ids []string) []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		for name, cached := range b.bucketIDs[connection] {
+			if cached.id == id {
+				names[i] = name
+				break
+			}
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,81 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketIDCache(t *testing.T) {
+	ctx := context.Background()
+	b, s, fake := getTestBackendWithFakeB2(t)
+	dataID := fake.addBucket("data")
+
+	role := backblazeB2RoleEntry{
+		Capabilities: []string{"readFiles"},
+		BucketNames:  []string{"data"},
+	}
+
+	createKey := func(t *testing.T) *fakeB2Key {
+		key, err := b.b2ApplicationKeyCreate(ctx, s, "vault-test", role)
+		require.NoError(t, err)
+		return fake.key(key.ID)
+	}
+
+	t.Run("Lookups are cached", func(t *testing.T) {
+		require.Equal(t, []string{dataID}, createKey(t).BucketIDs)
+		require.Equal(t, []string{dataID}, createKey(t).BucketIDs)
+		require.Equal(t, 1, fake.bucketLookups)
+	})
+
+	t.Run("Expired entries are looked up again", func(t *testing.T) {
+		b.lock.Lock()
+		b.bucketIDs[defaultConnectionName]["data"] = cachedBucketID{
+			id:      dataID,
+			expires: time.Now().Add(-time.Second),
+		}
+		b.lock.Unlock()
+
+		createKey(t)
+		require.Equal(t, 2, fake.bucketLookups)
+	})
+
+	t.Run("Config change clears the cache", func(t *testing.T) {
+		b.invalidate(ctx, configStoragePath)
+
+		createKey(t)
+		require.Equal(t, 3, fake.bucketLookups)
+	})
+
+	t.Run("Failed key creation clears the cache", func(t *testing.T) {
+		fake.createErr = errors.New("bad_request: invalid bucket ID")
+		_, err := b.b2ApplicationKeyCreate(ctx, s, "vault-test", role)
+		require.Error(t, err)
+		fake.createErr = nil
+
+		createKey(t)
+		require.Equal(t, 4, fake.bucketLookups)
+	})
+
+	t.Run("Connections are cached separately", func(t *testing.T) {
+		rootKey, err := fake.addKey("other-root", b2KeyOptions{Capabilities: append(rootKeyCapabilities, "listBuckets")})
+		require.NoError(t, err)
+
+		resp, err := testConnectionWrite(b, s, "other", map[string]interface{}{
+			"application_key_id": rootKey.ID,
+			"application_key":    rootKey.Secret,
+			"skip_verify":        true,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		other := role
+		other.Connection = "other"
+		_, err = b.b2ApplicationKeyCreate(ctx, s, "vault-test", other)
+		require.NoError(t, err)
+		require.Equal(t, 5, fake.bucketLookups)
+	})
+}
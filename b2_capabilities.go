@@ -0,0 +1,115 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// b2Capabilities is the catalog of application key capabilities B2
+// knows about. See
+// https://www.backblaze.com/docs/cloud-storage-application-key-capabilities
+var b2Capabilities = []string{
+	// Keys
+	"listKeys",
+	"writeKeys",
+	"deleteKeys",
+
+	// Buckets
+	"listBuckets",
+	"listAllBucketNames",
+	"readBuckets",
+	"writeBuckets",
+	"deleteBuckets",
+	"readBucketRetentions",
+	"writeBucketRetentions",
+	"readBucketEncryption",
+	"writeBucketEncryption",
+	"readBucketNotifications",
+	"writeBucketNotifications",
+	"readBucketReplications",
+	"writeBucketReplications",
+	"readBucketLogging",
+	"writeBucketLogging",
+
+	// Files
+	"listFiles",
+	"readFiles",
+	"shareFiles",
+	"writeFiles",
+	"deleteFiles",
+	"readFileLegalHolds",
+	"writeFileLegalHolds",
+	"readFileRetentions",
+	"writeFileRetentions",
+	"bypassGovernance",
+}
+
+// validateCapabilities checks capabilities against the catalog, and
+// suggests known capabilities for any it doesn't recognize
+func validateCapabilities(capabilities []string) error {
+	var unknown []string
+	for _, capability := range capabilities {
+		if slices.Contains(b2Capabilities, capability) {
+			continue
+		}
+
+		if suggestion := suggestCapability(capability); suggestion != "" {
+			unknown = append(unknown, fmt.Sprintf("%q (did you mean %q?)", capability, suggestion))
+		} else {
+			unknown = append(unknown, fmt.Sprintf("%q", capability))
+		}
+	}
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown capabilities %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// maxSuggestionDistance is how many edits away from a known capability
+// an unknown one can be and still be taken for a typo
+const maxSuggestionDistance = 3
+
+// suggestCapability returns the known capability closest to an unknown
+// one, or "" if none is close enough to be a likely typo
+func suggestCapability(capability string) string {
+	best, bestDistance := "", maxSuggestionDistance+1
+
+	for _, known := range b2Capabilities {
+		distance := editDistance(strings.ToLower(known), strings.ToLower(capability))
+		if distance < bestDistance {
+			best, bestDistance = known, distance
+		}
+	}
+
+	return best
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
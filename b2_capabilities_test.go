@@ -0,0 +1,33 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCapabilities(t *testing.T) {
+	require.NoError(t, validateCapabilities(b2Capabilities))
+	require.NoError(t, validateCapabilities([]string{"readBucketEncryption", "writeFileLegalHolds", "bypassGovernance"}))
+
+	err := validateCapabilities([]string{"readFiles", "readFile", "ListBuckets", "launchRockets"})
+	require.EqualError(t, err, `unknown capabilities "readFile" (did you mean "readFiles"?), "ListBuckets" (did you mean "listBuckets"?), "launchRockets"`)
+}
+
+func TestSuggestCapability(t *testing.T) {
+	tests := map[string]string{
+		"readFile":             "readFiles",
+		"writefiles":           "writeFiles",
+		"deleteKey":            "deleteKeys",
+		"readBucketEncryptoin": "readBucketEncryption",
+		"shareFile":            "shareFiles",
+		"something":            "",
+		"":                     "",
+	}
+
+	for capability, suggestion := range tests {
+		t.Run(capability, func(t *testing.T) {
+			require.Equal(t, suggestion, suggestCapability(capability))
+		})
+	}
+}
@@ -1,67 +1,503 @@
 package vault_plugin_secrets_backblazeb2
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	b2client "github.com/Backblaze/blazer/b2"
+	"github.com/hashicorp/go-cleanhttp"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
-// Call this to set a new b2client in the backend.
-func (b *backblazeB2Backend) newB2Client(ctx context.Context, applicationKeyID string, applicationKey string) error {
+// b2Key is an application key as returned by b2API. Secret is only
+// set on newly created keys.
+type b2Key struct {
+	ID           string
+	Secret       string
+	Name         string
+	Capabilities []string
 
-	b.Logger().Debug("newB2Client", "applicationKeyID", applicationKeyID)
+	// AccountID, BucketIDs and NamePrefix are filled in when a
+	// key is created, but not when one is looked up
+	AccountID  string
+	BucketIDs  []string
+	NamePrefix string
 
-	client, err := b2client.NewClient(ctx, applicationKeyID, applicationKey)
+	// Expires is zero if the key never expires
+	Expires time.Time
+}
+
+// b2KeyOptions describes the restrictions on a new application key
+type b2KeyOptions struct {
+	Capabilities []string
+
+	// BucketIDs restricts the key to the given buckets, and NamePrefix
+	// further restricts it to files whose names start with the prefix
+	BucketIDs  []string
+	NamePrefix string
+
+	// Lifetime makes B2 expire the key once it has passed, zero
+	// for a key which never expires
+	Lifetime time.Duration
+}
+
+// b2API is the part of the B2 native API used by the backend. Each client
+// is authorized with a single connection's application key.
+type b2API interface {
+	// AccountInfo describes the application key the client was
+	// authorized with
+	AccountInfo(ctx context.Context) (*b2AccountInfo, error)
 
+	// CreateKey creates a new application key
+	CreateKey(ctx context.Context, name string, opts b2KeyOptions) (*b2Key, error)
+
+	// BucketID looks up the ID of a bucket by its name
+	BucketID(ctx context.Context, name string) (string, error)
+
+	// GetKey looks up an application key by its ID, returning nil if
+	// B2 has no such key
+	GetKey(ctx context.Context, applicationKeyId string) (*b2Key, error)
+
+	// DeleteKey deletes an application key by its ID. Deleting a key
+	// which no longer exists is not an error.
+	DeleteKey(ctx context.Context, applicationKeyId string) error
+
+	// ListKeys lists every application key in the account
+	ListKeys(ctx context.Context) ([]*b2Key, error)
+}
+
+// b2APIFactory creates a b2API client for a connection's configuration
+type b2APIFactory func(ctx context.Context, c *backblazeB2Config) (b2API, error)
+
+// blazerClient implements b2API using blazer, with direct calls for
+// what blazer does not expose
+type blazerClient struct {
+	client     *b2client.Client
+	httpClient *http.Client
+	config     *backblazeB2Config
+
+	// authMu guards auth, the authorization used for direct calls
+	authMu sync.Mutex
+	auth   *b2AccountInfo
+}
+
+// newBlazerClient is the b2APIFactory used outside of tests
+func newBlazerClient(ctx context.Context, c *backblazeB2Config) (b2API, error) {
+	transport, err := c.newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	// blazer only takes a transport, so the timeout is applied there
+	opts := []b2client.ClientOption{b2client.Transport(withRequestTimeout(transport, c.RequestTimeout))}
+	if c.ApiUrl != "" {
+		opts = append(opts, b2client.APIBase(c.ApiUrl))
+	}
+
+	client, err := b2client.NewClient(ctx, c.ApplicationKeyId, c.ApplicationKey, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blazerClient{
+		client:     client,
+		httpClient: &http.Client{Transport: transport, Timeout: c.RequestTimeout},
+		config:     c,
+	}, nil
+}
+
+func (c *blazerClient) AccountInfo(ctx context.Context) (*b2AccountInfo, error) {
+	return c.authorization(ctx, true)
+}
+
+// authorization returns the authorization used for direct calls,
+// authorizing again if there is none yet or refresh is set
+func (c *blazerClient) authorization(ctx context.Context, refresh bool) (*b2AccountInfo, error) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if c.auth != nil && !refresh {
+		return c.auth, nil
+	}
+
+	info, err := authorizeAccount(ctx, c.httpClient, c.config.ApiUrl, c.config.ApplicationKeyId, c.config.ApplicationKey)
+	if err != nil {
+		return nil, err
+	}
+
+	c.auth = info
+	return info, nil
+}
+
+// call makes a B2 API call directly. The request body is built for the
+// authorized account, and if the authorization token has expired the
+// account is authorized again and the call retried once.
+func (c *blazerClient) call(ctx context.Context, path string, body func(accountId string) interface{}, v interface{}) error {
+	auth, err := c.authorization(ctx, false)
 	if err != nil {
-		b.Logger().Error("Error getting new b2 client", "error", err)
 		return err
 	}
 
+	expired, err := c.post(ctx, auth, path, body(auth.AccountId), v)
+	if !expired {
+		return err
+	}
+
+	if auth, err = c.authorization(ctx, true); err != nil {
+		return err
+	}
+
+	_, err = c.post(ctx, auth, path, body(auth.AccountId), v)
+	return err
+}
+
+// post sends a single B2 API request, reporting whether it failed
+// because the authorization token has expired
+func (c *blazerClient) post(ctx context.Context, auth *b2AccountInfo, path string, body interface{}, v interface{}) (bool, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.ApiUrl+path, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var b2Err b2ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&b2Err); err != nil || b2Err.Code == "" {
+			return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+
+		expired := resp.StatusCode == http.StatusUnauthorized &&
+			(b2Err.Code == "expired_auth_token" || b2Err.Code == "bad_auth_token")
+		return expired, fmt.Errorf("%s (%d %s)", b2Err.Message, b2Err.Status, b2Err.Code)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return false, nil
+}
+
+// CreateKey calls b2_create_key directly, as blazer can only restrict
+// keys to a single bucket, which it looks up by name
+func (c *blazerClient) CreateKey(ctx context.Context, name string, opts b2KeyOptions) (*b2Key, error) {
+	req := b2CreateKeyRequest{
+		Capabilities: opts.Capabilities,
+		KeyName:      name,
+		BucketIds:    opts.BucketIDs,
+		NamePrefix:   opts.NamePrefix,
+	}
+
+	if opts.Lifetime > 0 {
+		req.ValidDurationInSeconds = int64(opts.Lifetime.Seconds())
+	}
+
+	var resp b2CreateKeyResponse
+	if err := c.call(ctx, b2CreateKeyPath, func(accountId string) interface{} {
+		req.AccountId = accountId
+		return &req
+	}, &resp); err != nil {
+		return nil, err
+	}
+
+	key := &b2Key{
+		ID:           resp.ApplicationKeyId,
+		Secret:       resp.ApplicationKey,
+		Name:         resp.KeyName,
+		Capabilities: resp.Capabilities,
+		AccountID:    resp.AccountId,
+		BucketIDs:    resp.BucketIds,
+		NamePrefix:   resp.NamePrefix,
+	}
+
+	if resp.ExpirationTimestamp != nil {
+		key.Expires = time.UnixMilli(*resp.ExpirationTimestamp)
+	}
+
+	return key, nil
+}
+
+func (c *blazerClient) BucketID(ctx context.Context, name string) (string, error) {
+	var resp b2ListBucketsResponse
+	if err := c.call(ctx, b2ListBucketsPath, func(accountId string) interface{} {
+		return &b2ListBucketsRequest{
+			AccountId:  accountId,
+			BucketName: name,
+		}
+	}, &resp); err != nil {
+		return "", fmt.Errorf("failed to look up bucket %q: %w", name, err)
+	}
+
+	for _, bucket := range resp.Buckets {
+		if bucket.BucketName == name {
+			return bucket.BucketId, nil
+		}
+	}
+
+	return "", fmt.Errorf("bucket %q not found", name)
+}
+
+func (c *blazerClient) GetKey(ctx context.Context, applicationKeyId string) (*b2Key, error) {
+	key, err := c.findKey(ctx, applicationKeyId)
+	if err != nil || key == nil {
+		return nil, err
+	}
+
+	return newB2Key(key), nil
+}
+
+func (c *blazerClient) DeleteKey(ctx context.Context, applicationKeyId string) error {
+	// blazer can only delete keys it has listed
+	key, err := c.findKey(ctx, applicationKeyId)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return nil
+	}
+
+	return key.Delete(ctx)
+}
+
+func (c *blazerClient) ListKeys(ctx context.Context) ([]*b2Key, error) {
+	var keys []*b2Key
+
+	cursor := ""
+	for {
+		// ListKeys returns io.EOF alongside the final page of keys
+		page, next, err := c.client.ListKeys(ctx, 1000, cursor)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		for _, key := range page {
+			keys = append(keys, newB2Key(key))
+		}
+
+		if err != nil || next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// findKey looks up a blazer key by its ID, returning nil if B2 has no
+// such key
+func (c *blazerClient) findKey(ctx context.Context, applicationKeyId string) (*b2client.Key, error) {
+	// ListKeys returns io.EOF alongside the final page of keys
+	keys, _, err := c.client.ListKeys(ctx, 1, applicationKeyId)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	// Listing starts at the requested ID, so we should only get
+	// the one we asked for, but verify
+	for _, key := range keys {
+		if key.ID() == applicationKeyId {
+			return key, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func newB2Key(key *b2client.Key) *b2Key {
+	k := &b2Key{
+		ID:           key.ID(),
+		Secret:       key.Secret(),
+		Name:         key.Name(),
+		Capabilities: key.Capabilities(),
+	}
+
+	// blazer reports keys which never expire as expiring at the epoch
+	if expires := key.Expires(); expires.UnixMilli() != 0 {
+		k.Expires = expires
+	}
+
+	return k
+}
+
+// Call this to set a new b2client for a connection in the backend.
+func (b *backblazeB2Backend) newB2Client(ctx context.Context, name string, c *backblazeB2Config) (b2API, error) {
+
+	b.Logger().Debug("newB2Client", "connection", name, "applicationKeyID", c.ApplicationKeyId)
+
+	client, err := b.newB2API(ctx, c)
+
+	if err != nil {
+		b.Logger().Error("Error getting new b2 client", "error", err)
+		return nil, err
+	}
+
 	b.Logger().Debug("Getting clientMutex.Lock")
 	b.lock.Lock()
 	defer b.lock.Unlock()
 
-	b.client = client
-	b.Logger().Debug("Set new b.client, unlocking and returning")
-	return nil
+	b.clients[name] = client
+	b.Logger().Debug("Set new client, unlocking and returning")
+	return client, nil
 }
 
-// Convenience function to get the b2client
-func (b *backblazeB2Backend) getB2Client(ctx context.Context, s logical.Storage) (*b2client.Client, error) {
-	b.Logger().Debug("getB2Client, getting clientMutex.RLock")
+// Convenience function to get the b2client for the mount's default config
+func (b *backblazeB2Backend) getB2Client(ctx context.Context, s logical.Storage) (b2API, error) {
+	return b.getConnectionClient(ctx, s, defaultConnectionName)
+}
+
+// getConnectionClient returns the b2client for a named connection,
+// creating it from the stored configuration if need be
+func (b *backblazeB2Backend) getConnectionClient(ctx context.Context, s logical.Storage, name string) (b2API, error) {
+	b.Logger().Debug("getConnectionClient, getting clientMutex.RLock", "connection", name)
 	b.lock.RLock()
-	if b.client != nil {
+	if client, ok := b.clients[name]; ok {
 		b.Logger().Debug("have client already, unlocking and returning")
 		b.lock.RUnlock()
-		return b.client, nil
+		return client, nil
 	}
 	b.lock.RUnlock()
 
 	// We don't have a current client, look up the id and key
 	// from the current configuration and create a new client
 
-	b.Logger().Info("Getting new b2 client, fetching config")
-	c, err := b.getConfig(ctx, s)
+	b.Logger().Info("Getting new b2 client, fetching config", "connection", name)
+	c, err := b.getConnection(ctx, s, name)
 	if err != nil {
 		b.Logger().Error("Error fetching configuration to make new b2client", "error", err)
 		return nil, err
 	}
 
+	if c == nil {
+		if name == defaultConnectionName {
+			return nil, errors.New("backend is not configured")
+		}
+		return nil, fmt.Errorf("connection %q is not configured", name)
+	}
+
 	if c.ApplicationKeyId == "" {
 		b.Logger().Error("KeyID not set when trying to create new client")
-		return nil, err
+		return nil, errors.New("application_key_id is not set")
 	}
 
 	if c.ApplicationKey == "" {
 		b.Logger().Error("Key not set when trying to create new client")
+		return nil, errors.New("application_key is not set")
+	}
+
+	return b.newB2Client(ctx, name, c)
+}
+
+// newTransport builds the HTTP transport used to talk to B2 from the
+// proxy and TLS settings in the configuration. request_timeout is applied
+// by the client, or withRequestTimeout where there is none.
+func (c *backblazeB2Config) newTransport() (*http.Transport, error) {
+	transport := cleanhttp.DefaultPooledTransport()
+
+	if c.ProxyUrl != "" {
+		proxyURL, err := parseHTTPURL(c.ProxyUrl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if c.CACert != "" || c.TLSSkipVerify {
+		tlsConfig := &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: c.TLSSkipVerify,
+		}
+
+		if c.CACert != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(c.CACert)) {
+				return nil, errors.New("invalid ca_cert: no PEM encoded certificates found")
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return transport, nil
+}
+
+// withRequestTimeout limits each request made through rt, including
+// reading the response body, to timeout. A zero timeout means no limit.
+func withRequestTimeout(rt http.RoundTripper, timeout time.Duration) http.RoundTripper {
+	if timeout <= 0 {
+		return rt
+	}
+
+	return &timeoutTransport{base: rt, timeout: timeout}
+}
+
+type timeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	if err := b.newB2Client(ctx, c.ApplicationKeyId, c.ApplicationKey); err != nil {
+	// The deadline has to last until the body has been read
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context when its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// parseHTTPURL parses an absolute http or https URL
+func parseHTTPURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
 		return nil, err
 	}
 
-	return b.client, nil
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+
+	return u, nil
 }
@@ -0,0 +1,316 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Boostport/vault-plugin-secrets-backblazeb2/internal/b2test"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRootKey(server *b2test.Server) b2test.Key {
+	return server.AddKey(b2test.Key{
+		Name:         "vault-root",
+		Capabilities: []string{"listKeys", "writeKeys", "deleteKeys", "listBuckets"},
+	})
+}
+
+func TestBlazerClient(t *testing.T) {
+	ctx := context.Background()
+	server := b2test.NewServer(t)
+	bucketID := server.AddBucket("backups")
+	logsBucketID := server.AddBucket("logs")
+	root := newTestRootKey(server)
+
+	client, err := newBlazerClient(ctx, &backblazeB2Config{
+		ApplicationKeyId: root.ID,
+		ApplicationKey:   root.Secret,
+		ApiUrl:           server.URL,
+	})
+	require.NoError(t, err)
+
+	t.Run("Invalid credentials", func(t *testing.T) {
+		_, err := newBlazerClient(ctx, &backblazeB2Config{
+			ApplicationKeyId: root.ID,
+			ApplicationKey:   "wrong",
+			ApiUrl:           server.URL,
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("AccountInfo", func(t *testing.T) {
+		info, err := client.AccountInfo(ctx)
+		require.NoError(t, err)
+		require.Equal(t, server.AccountID, info.AccountId)
+		require.Equal(t, server.URL, info.ApiUrl)
+		require.ElementsMatch(t, root.Capabilities, info.Capabilities)
+		require.Empty(t, info.BucketId)
+		require.True(t, info.KeyExpiration.IsZero())
+	})
+
+	t.Run("CreateKey", func(t *testing.T) {
+		key, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"listFiles", "readFiles"},
+		})
+		require.NoError(t, err)
+		require.NotEmpty(t, key.Secret)
+		require.Equal(t, "vault-test", key.Name)
+
+		created := server.Key(key.ID)
+		require.NotNil(t, created)
+		require.Equal(t, key.Secret, created.Secret)
+		require.Equal(t, []string{"listFiles", "readFiles"}, created.Capabilities)
+		require.Empty(t, created.BucketIDs)
+	})
+
+	t.Run("CreateKey - bucket and prefix", func(t *testing.T) {
+		key, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+			BucketIDs:    []string{bucketID},
+			NamePrefix:   "logs/",
+		})
+		require.NoError(t, err)
+		require.Equal(t, server.AccountID, key.AccountID)
+		require.Equal(t, []string{bucketID}, key.BucketIDs)
+		require.Equal(t, "logs/", key.NamePrefix)
+
+		created := server.Key(key.ID)
+		require.NotNil(t, created)
+		require.Equal(t, []string{bucketID}, created.BucketIDs)
+		require.Equal(t, "logs/", created.NamePrefix)
+	})
+
+	t.Run("CreateKey - several buckets", func(t *testing.T) {
+		key, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+			BucketIDs:    []string{bucketID, logsBucketID},
+		})
+		require.NoError(t, err)
+
+		created := server.Key(key.ID)
+		require.NotNil(t, created)
+		require.Equal(t, []string{bucketID, logsBucketID}, created.BucketIDs)
+	})
+
+	t.Run("CreateKey - lifetime", func(t *testing.T) {
+		key, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+			Lifetime:     2 * time.Hour,
+		})
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now().Add(2*time.Hour), key.Expires, time.Minute)
+
+		created := server.Key(key.ID)
+		require.NotNil(t, created)
+		require.WithinDuration(t, key.Expires, created.Expires, time.Second)
+	})
+
+	t.Run("CreateKey - unknown bucket", func(t *testing.T) {
+		_, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+			BucketIDs:    []string{"missing"},
+		})
+		require.Error(t, err)
+	})
+
+	t.Run("BucketID", func(t *testing.T) {
+		id, err := client.BucketID(ctx, "logs")
+		require.NoError(t, err)
+		require.Equal(t, logsBucketID, id)
+
+		_, err = client.BucketID(ctx, "missing")
+		require.ErrorContains(t, err, "not found")
+	})
+
+	t.Run("CreateKey - B2 error", func(t *testing.T) {
+		server.Fail("b2_create_key", http.StatusBadRequest, "bad_request")
+
+		_, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+		})
+		require.ErrorContains(t, err, "simulated failure")
+	})
+
+	t.Run("GetKey and DeleteKey", func(t *testing.T) {
+		key, err := client.CreateKey(ctx, "vault-delete", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+		})
+		require.NoError(t, err)
+
+		found, err := client.GetKey(ctx, key.ID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		require.Equal(t, "vault-delete", found.Name)
+		require.Empty(t, found.Secret)
+		require.True(t, found.Expires.IsZero())
+
+		err = client.DeleteKey(ctx, key.ID)
+		require.NoError(t, err)
+		require.Nil(t, server.Key(key.ID))
+
+		found, err = client.GetKey(ctx, key.ID)
+		require.NoError(t, err)
+		require.Nil(t, found)
+
+		// Deleting a missing key is not an error
+		err = client.DeleteKey(ctx, key.ID)
+		require.NoError(t, err)
+	})
+
+	t.Run("ListKeys", func(t *testing.T) {
+		keys, err := client.ListKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, keys, len(server.Keys()))
+
+		var names []string
+		for _, key := range keys {
+			require.Empty(t, key.Secret)
+			names = append(names, key.Name)
+		}
+		require.Contains(t, names, "vault-root")
+	})
+
+	t.Run("Expired auth token", func(t *testing.T) {
+		authorizations := server.Requests("b2_authorize_account")
+		server.Fail("b2_list_keys", http.StatusUnauthorized, "expired_auth_token")
+
+		found, err := client.GetKey(ctx, root.ID)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+
+		// blazer authorizes again and retries
+		require.Equal(t, authorizations+1, server.Requests("b2_authorize_account"))
+	})
+
+	t.Run("Expired auth token - direct call", func(t *testing.T) {
+		authorizations := server.Requests("b2_authorize_account")
+		server.Fail("b2_create_key", http.StatusUnauthorized, "expired_auth_token")
+
+		_, err := client.CreateKey(ctx, "vault-test", b2KeyOptions{
+			Capabilities: []string{"readFiles"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, authorizations+1, server.Requests("b2_authorize_account"))
+
+		// The new token is reused
+		_, err = client.BucketID(ctx, "backups")
+		require.NoError(t, err)
+		require.Equal(t, authorizations+1, server.Requests("b2_authorize_account"))
+	})
+}
+
+// TestBackendWithB2Emulator runs the backend against the B2 emulator, so
+// requests go through blazer and the real HTTP client
+func TestBackendWithB2Emulator(t *testing.T) {
+	ctx := context.Background()
+	b, s := getTestBackend(t)
+	server := b2test.NewServer(t)
+	bucketID := server.AddBucket("backups")
+	logsBucketID := server.AddBucket("logs")
+	root := newTestRootKey(server)
+
+	err := testConfigCreate(b, s, map[string]interface{}{
+		"application_key_id": root.ID,
+		"application_key":    root.Secret,
+		"api_url":            server.URL,
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      configStoragePath,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, server.AccountID, resp.Data["account_id"])
+	require.Equal(t, "vault-root", resp.Data["application_key_name"])
+
+	resp, err = testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": []string{"listFiles", "readFiles"},
+		"bucket_names": "backups,logs",
+		"name_prefix":  "logs/",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	readCreds := func(t *testing.T) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp.Secret)
+
+		key := server.Key(resp.Data["application_key_id"].(string))
+		require.NotNil(t, key)
+		require.Equal(t, []string{bucketID, logsBucketID}, key.BucketIDs)
+		require.Equal(t, "logs/", key.NamePrefix)
+		require.Equal(t, server.URL, resp.Data["s3_endpoint"])
+
+		return resp
+	}
+
+	revoke := func(t *testing.T, secret *logical.Secret) {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+		require.Nil(t, server.Key(secret.InternalData["application_key_id"].(string)))
+	}
+
+	resp = readCreds(t)
+	revoke(t, resp.Secret)
+
+	// Revoking again finds nothing to delete, which is fine
+	revoke(t, resp.Secret)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/rotate-root",
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+	require.Nil(t, server.Key(root.ID))
+
+	// The rotated key keeps working
+	resp = readCreds(t)
+	revoke(t, resp.Secret)
+
+	require.Len(t, server.Keys(), 1)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// Send the headers straight away, then stall the body
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: withRequestTimeout(http.DefaultTransport, 100*time.Millisecond)}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	start := time.Now()
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	require.Equal(t, http.DefaultTransport, withRequestTimeout(http.DefaultTransport, 0))
+}
@@ -2,23 +2,63 @@ package vault_plugin_secrets_backblazeb2
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
-	b2client "github.com/Backblaze/blazer/b2"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
+// walRollbackMinAge is how old a WAL entry must be before it is rolled
+// back, leaving in-flight operations time to finish on their own
+const walRollbackMinAge = 5 * time.Minute
+
 type backblazeB2Backend struct {
 	*framework.Backend
 
-	client *b2client.Client
+	// clients holds a b2client for each connection, keyed by
+	// connection name with the default config under ""
+	clients map[string]b2API
+
+	// newB2API creates the clients, and is replaced in tests
+	newB2API b2APIFactory
+
+	// rootKeys caches what B2 reports about each connection's
+	// application key, and is reset along with the client
+	rootKeys map[string]*rootKeyMetadata
+
+	// bucketIDs caches bucket IDs by connection and bucket name, and
+	// is reset along with the client
+	bucketIDs map[string]map[string]cachedBucketID
+
+	// accounts caches each connection's account details, such as its
+	// API endpoints, and is reset along with the client
+	accounts map[string]*b2AccountInfo
 
 	// We're going to have to be able to rotate the client
 	// if the mount configured credentials change, use
 	// this to protect it
 	lock sync.RWMutex
+
+	// rootRotationLock makes sure only one rotation of the root
+	// application key, manual or scheduled, runs at a time
+	rootRotationLock sync.Mutex
+
+	// staticRoleLocks serialize changes to each static role
+	// and its application key
+	staticRoleLocks []*locksutil.LockEntry
+
+	// librarySetLocks serialize check-outs, check-ins and
+	// changes to each library set
+	librarySetLocks []*locksutil.LockEntry
+
+	// tidyLock makes sure only one tidy, manual or periodic, runs
+	// at a time
+	tidyLock sync.Mutex
 }
 
 // Factory returns a configured instance of the B2 backend
@@ -43,7 +83,10 @@ func backend(version string) *backblazeB2Backend {
 		PathsSpecial: &logical.Paths{
 			SealWrapStorage: []string{
 				"config",
+				"config/connections/*",
 				"role/*",
+				"static-roles/*",
+				"library/*",
 			},
 		},
 		Paths: []*framework.Path{
@@ -51,6 +94,12 @@ func backend(version string) *backblazeB2Backend {
 			// ^config
 			b.pathConfigCRUD(),
 
+			// path_config_connections.go
+			// ^config/connections (LIST)
+			b.pathConnections(),
+			// ^config/connections/<name>
+			b.pathConnectionsCRUD(),
+
 			// path_config_rotate.go
 			// ^config/rotate-root
 			b.pathConfigRotate(),
@@ -61,34 +110,131 @@ func backend(version string) *backblazeB2Backend {
 			// ^roles/<role>
 			b.pathRolesCRUD(),
 
+			// path_capability_sets.go
+			// ^capability-sets (LIST)
+			b.pathCapabilitySets(),
+			// ^capability-sets/<name>
+			b.pathCapabilitySetsCRUD(),
+
 			// path_credentials.go
 			// ^creds/<role>
 			b.pathCredentials(),
+
+			// path_keys.go
+			// ^keys (LIST)
+			b.pathKeys(),
+			// ^keys/<application_key_id>
+			b.pathKeysRead(),
+
+			// path_tidy.go
+			// ^tidy
+			b.pathTidy(),
+			// ^config/auto-tidy
+			b.pathAutoTidyConfig(),
+
+			// path_static_roles.go
+			// ^static-roles (LIST)
+			b.pathStaticRoles(),
+			// ^static-roles/<name>
+			b.pathStaticRolesCRUD(),
+
+			// path_static_roles_rotate.go
+			// ^rotate-role/<name>
+			b.pathStaticRoleRotate(),
+
+			// path_static_credentials.go
+			// ^static-creds/<name>
+			b.pathStaticCredentials(),
+
+			// path_library.go
+			// ^library (LIST)
+			b.pathLibrary(),
+			// ^library/<name>
+			b.pathLibraryCRUD(),
+			// ^library/<name>/status
+			b.pathLibraryStatus(),
+
+			// path_library_checkout.go
+			// ^library/<name>/check-out
+			b.pathLibraryCheckOut(),
+			// ^library/<name>/check-in
+			b.pathLibraryCheckIn(),
+			// ^library/manage/<name>/check-in
+			b.pathLibraryManageCheckIn(),
 		},
 		Secrets: []*framework.Secret{
 			b.b2ApplicationsKey(),
+			b.libraryKeys(),
 		},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		BackendType:  logical.TypeLogical,
+		Invalidate:   b.invalidate,
+		PeriodicFunc: b.periodicFunc,
+
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
 	}
 
 	if version != "" {
 		b.Backend.RunningVersion = fmt.Sprintf("v%s", version)
 	}
 
-	b.client = (*b2client.Client)(nil)
+	b.clients = make(map[string]b2API)
+	b.newB2API = newBlazerClient
+	b.rootKeys = make(map[string]*rootKeyMetadata)
+	b.bucketIDs = make(map[string]map[string]cachedBucketID)
+	b.accounts = make(map[string]*b2AccountInfo)
+	b.staticRoleLocks = locksutil.CreateLocks()
+	b.librarySetLocks = locksutil.CreateLocks()
 
 	return &b
 }
 
 func (b *backblazeB2Backend) reset() {
+	b.resetConnection(defaultConnectionName)
+}
+
+// resetConnection drops the cached client for a connection, so the next
+// request picks up its current configuration
+func (b *backblazeB2Backend) resetConnection(name string) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	b.client = nil
+	delete(b.clients, name)
+	delete(b.rootKeys, name)
+	delete(b.bucketIDs, name)
+	delete(b.accounts, name)
 }
 
 func (b *backblazeB2Backend) invalidate(_ context.Context, key string) {
-	if key == configStoragePath {
+	switch {
+	case key == configStoragePath:
 		b.reset()
+	case strings.HasPrefix(key, connectionStoragePrefix):
+		b.resetConnection(strings.TrimPrefix(key, connectionStoragePrefix))
+	}
+}
+
+func (b *backblazeB2Backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// Only rotate and tidy where we're allowed to write
+	if !b.WriteSafeReplicationState() {
+		return nil
+	}
+
+	return errors.Join(
+		b.rotateRootIfDue(ctx, req.Storage),
+		b.rotateStaticRolesIfDue(ctx, req.Storage),
+		b.autoTidyIfDue(ctx, req.Storage),
+	)
+}
+
+func (b *backblazeB2Backend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	switch kind {
+	case rootRotationWALKind:
+		return b.rootRotationRollback(ctx, req, data)
+	case staticRotationWALKind:
+		return b.staticRotationRollback(ctx, req, data)
+	case libraryKeyWALKind:
+		return b.libraryKeyRollback(ctx, req, data)
+	default:
+		return fmt.Errorf("unknown WAL entry kind %q", kind)
 	}
 }
@@ -2,6 +2,8 @@ package vault_plugin_secrets_backblazeb2
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 
@@ -32,6 +34,20 @@ func getTestBackend(tb testing.TB) (*backblazeB2Backend, logical.Storage) {
 	return b.(*backblazeB2Backend), config.StorageView
 }
 
+// newOfflineB2Server starts a server which rejects every B2 API request,
+// so tests using made up credentials never reach the real B2 API.
+func newOfflineB2Server(tb testing.TB) *httptest.Server {
+	tb.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"status": 401, "code": "unauthorized", "message": "offline test server"}`))
+	}))
+	tb.Cleanup(server.Close)
+
+	return server
+}
+
 // runAcceptanceTests will separate unit tests from
 // acceptance tests, which will make active requests
 // to your target API.
@@ -128,20 +144,8 @@ func (e *testCloudEnv) CleanupCreds(t *testing.T) {
 	}
 
 	for _, id := range e.ApplicationKeyIDs {
-		keys, _, err := client.ListKeys(context.Background(), 1, id)
-		if err != nil {
-			t.Fatalf("error listing keys: %s", err)
-		}
-
-		// We should only get one, but verify
-		for _, key := range keys {
-			if key.ID() == id {
-				err = key.Delete(context.Background())
-				if err != nil {
-					t.Fatalf("error deleting key: %s", err)
-				}
-				break
-			}
+		if err := client.DeleteKey(context.Background(), id); err != nil {
+			t.Fatalf("error deleting key: %s", err)
 		}
 	}
 }
@@ -0,0 +1,83 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// credentialFormats are the client configurations credentials can be
+// rendered as
+var credentialFormats = []string{"rclone", "aws-profile", "dotenv", "restic-env"}
+
+// renderedCredentials is what goes into a rendered client configuration
+type renderedCredentials struct {
+	// Name names the rclone remote or AWS profile
+	Name string
+
+	ApplicationKeyID string
+	ApplicationKey   string
+	S3Endpoint       string
+	Region           string
+
+	// BucketName and NamePrefix are used where a client configuration
+	// points at a location, and only if the key has a single bucket
+	BucketName string
+	NamePrefix string
+}
+
+// validateCredentialFormat makes sure format is one that can be rendered
+func validateCredentialFormat(format string) error {
+	if !slices.Contains(credentialFormats, format) {
+		return fmt.Errorf("unknown format %q, must be one of %s", format, strings.Join(credentialFormats, ", "))
+	}
+
+	return nil
+}
+
+// render returns the credentials as a configuration snippet for the
+// given client
+func (c renderedCredentials) render(format string) (string, error) {
+	var b strings.Builder
+
+	switch format {
+	case "rclone":
+		fmt.Fprintf(&b, "[%s]\n", c.Name)
+		b.WriteString("type = b2\n")
+		fmt.Fprintf(&b, "account = %s\n", c.ApplicationKeyID)
+		fmt.Fprintf(&b, "key = %s\n", c.ApplicationKey)
+	case "aws-profile":
+		// The AWS config file, unlike the credentials file, takes the
+		// endpoint and region as well as the keys
+		fmt.Fprintf(&b, "[profile %s]\n", c.Name)
+		fmt.Fprintf(&b, "aws_access_key_id = %s\n", c.ApplicationKeyID)
+		fmt.Fprintf(&b, "aws_secret_access_key = %s\n", c.ApplicationKey)
+		if c.Region != "" {
+			fmt.Fprintf(&b, "region = %s\n", c.Region)
+		}
+		fmt.Fprintf(&b, "endpoint_url = %s\n", c.S3Endpoint)
+	case "dotenv":
+		fmt.Fprintf(&b, "B2_APPLICATION_KEY_ID=%s\n", c.ApplicationKeyID)
+		fmt.Fprintf(&b, "B2_APPLICATION_KEY=%s\n", c.ApplicationKey)
+		fmt.Fprintf(&b, "AWS_ACCESS_KEY_ID=%s\n", c.ApplicationKeyID)
+		fmt.Fprintf(&b, "AWS_SECRET_ACCESS_KEY=%s\n", c.ApplicationKey)
+		if c.Region != "" {
+			fmt.Fprintf(&b, "AWS_REGION=%s\n", c.Region)
+		}
+		fmt.Fprintf(&b, "AWS_ENDPOINT_URL=%s\n", c.S3Endpoint)
+	case "restic-env":
+		fmt.Fprintf(&b, "export B2_ACCOUNT_ID=%s\n", c.ApplicationKeyID)
+		fmt.Fprintf(&b, "export B2_ACCOUNT_KEY=%s\n", c.ApplicationKey)
+		if c.BucketName != "" {
+			repository := "b2:" + c.BucketName
+			if path := strings.TrimSuffix(c.NamePrefix, "/"); path != "" {
+				repository += ":" + path
+			}
+			fmt.Fprintf(&b, "export RESTIC_REPOSITORY=%s\n", repository)
+		}
+	default:
+		return "", validateCredentialFormat(format)
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,55 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderedCredentials(t *testing.T) {
+	credentials := renderedCredentials{
+		Name:             "backups",
+		ApplicationKeyID: "key-id",
+		ApplicationKey:   "secret",
+		S3Endpoint:       "https://s3.us-west-004.backblazeb2.com",
+		Region:           "us-west-004",
+		BucketName:       "data",
+		NamePrefix:       "restic/",
+	}
+
+	for format, expected := range map[string]string{
+		"rclone": "[backups]\n" +
+			"type = b2\n" +
+			"account = key-id\n" +
+			"key = secret\n",
+		"aws-profile": "[profile backups]\n" +
+			"aws_access_key_id = key-id\n" +
+			"aws_secret_access_key = secret\n" +
+			"region = us-west-004\n" +
+			"endpoint_url = https://s3.us-west-004.backblazeb2.com\n",
+		"dotenv": "B2_APPLICATION_KEY_ID=key-id\n" +
+			"B2_APPLICATION_KEY=secret\n" +
+			"AWS_ACCESS_KEY_ID=key-id\n" +
+			"AWS_SECRET_ACCESS_KEY=secret\n" +
+			"AWS_REGION=us-west-004\n" +
+			"AWS_ENDPOINT_URL=https://s3.us-west-004.backblazeb2.com\n",
+		"restic-env": "export B2_ACCOUNT_ID=key-id\n" +
+			"export B2_ACCOUNT_KEY=secret\n" +
+			"export RESTIC_REPOSITORY=b2:data:restic\n",
+	} {
+		config, err := credentials.render(format)
+		require.NoError(t, err, format)
+		require.Equal(t, expected, config, format)
+	}
+
+	t.Run("restic-env without a bucket", func(t *testing.T) {
+		config, err := renderedCredentials{ApplicationKeyID: "key-id", ApplicationKey: "secret"}.render("restic-env")
+		require.NoError(t, err)
+		require.NotContains(t, config, "RESTIC_REPOSITORY")
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		_, err := credentials.render("s3cmd")
+		require.ErrorContains(t, err, `unknown format "s3cmd"`)
+	})
+}
@@ -0,0 +1,336 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeB2 is an in-memory B2 account used in place of the real API. Clients
+// authorize with the ID and secret of one of its keys, and only see the
+// keys and buckets of this account.
+type fakeB2 struct {
+	mu sync.Mutex
+
+	accountID string
+	keys      map[string]*fakeB2Key
+
+	// buckets maps bucket names to IDs
+	buckets map[string]string
+
+	// bucketLookups counts BucketID calls
+	bucketLookups int
+
+	// keyLookups counts GetKey calls
+	keyLookups int
+
+	nextID int
+
+	// createErr and deleteErr, if set, are returned by every
+	// CreateKey and DeleteKey call
+	createErr error
+	deleteErr error
+
+	// accountErr, if set, is returned by every AccountInfo call
+	accountErr error
+}
+
+type fakeB2Key struct {
+	b2Key
+
+	BucketNames []string
+}
+
+func newFakeB2() *fakeB2 {
+	return &fakeB2{
+		accountID: "fake-account",
+		keys:      make(map[string]*fakeB2Key),
+		buckets:   make(map[string]string),
+	}
+}
+
+// addBucket creates a bucket and returns its ID
+func (f *fakeB2) addBucket(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.nextID++
+	id := fmt.Sprintf("bucket-%d", f.nextID)
+	f.buckets[name] = id
+
+	return id
+}
+
+// addKey creates a key directly in the account, as if made outside Vault
+func (f *fakeB2) addKey(name string, opts b2KeyOptions) (*b2Key, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.createKey(name, opts)
+}
+
+func (f *fakeB2) createKey(name string, opts b2KeyOptions) (*b2Key, error) {
+	if opts.NamePrefix != "" && len(opts.BucketIDs) == 0 {
+		return nil, errors.New("bad_request: a name prefix requires a bucket")
+	}
+
+	key := &fakeB2Key{}
+	key.AccountID = f.accountID
+	key.BucketIDs = slices.Clone(opts.BucketIDs)
+	key.NamePrefix = opts.NamePrefix
+
+	for _, id := range opts.BucketIDs {
+		name, ok := f.bucketName(id)
+		if !ok {
+			return nil, fmt.Errorf("bad_request: invalid bucket ID %q", id)
+		}
+		key.BucketNames = append(key.BucketNames, name)
+	}
+
+	f.nextID++
+	key.ID = fmt.Sprintf("key-%d", f.nextID)
+	key.Secret = fmt.Sprintf("secret-%d", f.nextID)
+	key.Name = name
+	key.Capabilities = slices.Clone(opts.Capabilities)
+	if opts.Lifetime > 0 {
+		key.Expires = time.Now().Add(opts.Lifetime)
+	}
+
+	f.keys[key.ID] = key
+
+	created := key.b2Key
+	return &created, nil
+}
+
+// bucketName looks up the name of a bucket by its ID. The caller must
+// hold the fake's lock.
+func (f *fakeB2) bucketName(id string) (string, bool) {
+	for name, bucketID := range f.buckets {
+		if bucketID == id {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// key returns a copy of a key in the account, or nil
+func (f *fakeB2) key(id string) *fakeB2Key {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key, ok := f.keys[id]
+	if !ok {
+		return nil
+	}
+
+	k := *key
+	return &k
+}
+
+// newClient is a b2APIFactory authorizing against the fake account
+func (f *fakeB2) newClient(_ context.Context, c *backblazeB2Config) (b2API, error) {
+	client := &fakeB2Client{
+		fake:             f,
+		applicationKeyId: c.ApplicationKeyId,
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key, err := client.authorizedKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if key.Secret != c.ApplicationKey {
+		return nil, errors.New("unauthorized: invalid application key")
+	}
+
+	return client, nil
+}
+
+type fakeB2Client struct {
+	fake             *fakeB2
+	applicationKeyId string
+}
+
+// authorizedKey returns the key the client authorized with. The caller
+// must hold the fake's lock.
+func (c *fakeB2Client) authorizedKey() (*fakeB2Key, error) {
+	key, ok := c.fake.keys[c.applicationKeyId]
+	if !ok {
+		return nil, errors.New("unauthorized: invalid application key")
+	}
+
+	return key, nil
+}
+
+// authorize checks the client's key is still valid and has a capability
+func (c *fakeB2Client) authorize(capability string) error {
+	key, err := c.authorizedKey()
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(key.Capabilities, capability) {
+		return fmt.Errorf("unauthorized: key is missing capability %s", capability)
+	}
+
+	return nil
+}
+
+func (c *fakeB2Client) AccountInfo(_ context.Context) (*b2AccountInfo, error) {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+
+	if c.fake.accountErr != nil {
+		return nil, c.fake.accountErr
+	}
+
+	key, err := c.authorizedKey()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &b2AccountInfo{
+		AccountId:     c.fake.accountID,
+		ApiUrl:        "https://api.fake.backblazeb2.com",
+		S3ApiUrl:      "https://s3.us-west-004.backblazeb2.com",
+		DownloadUrl:   "https://f000.fake.backblazeb2.com",
+		Capabilities:  slices.Clone(key.Capabilities),
+		NamePrefix:    key.NamePrefix,
+		KeyExpiration: key.Expires,
+	}
+
+	if len(key.BucketIDs) == 1 {
+		info.BucketId = key.BucketIDs[0]
+		info.BucketName = key.BucketNames[0]
+	}
+
+	return info, nil
+}
+
+func (c *fakeB2Client) BucketID(_ context.Context, name string) (string, error) {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+
+	c.fake.bucketLookups++
+
+	if err := c.authorize("listBuckets"); err != nil {
+		return "", err
+	}
+
+	id, ok := c.fake.buckets[name]
+	if !ok {
+		return "", fmt.Errorf("bucket %q not found", name)
+	}
+
+	return id, nil
+}
+
+func (c *fakeB2Client) CreateKey(_ context.Context, name string, opts b2KeyOptions) (*b2Key, error) {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+
+	if err := c.authorize("writeKeys"); err != nil {
+		return nil, err
+	}
+
+	if c.fake.createErr != nil {
+		return nil, c.fake.createErr
+	}
+
+	return c.fake.createKey(name, opts)
+}
+
+func (c *fakeB2Client) GetKey(_ context.Context, applicationKeyId string) (*b2Key, error) {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+
+	if err := c.authorize("listKeys"); err != nil {
+		return nil, err
+	}
+
+	c.fake.keyLookups++
+
+	key, ok := c.fake.keys[applicationKeyId]
+	if !ok {
+		return nil, nil
+	}
+
+	// Only the creation response includes the secret
+	listed := key.b2Key
+	listed.Secret = ""
+	return &listed, nil
+}
+
+func (c *fakeB2Client) DeleteKey(_ context.Context, applicationKeyId string) error {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+
+	if err := c.authorize("deleteKeys"); err != nil {
+		return err
+	}
+
+	if c.fake.deleteErr != nil {
+		return c.fake.deleteErr
+	}
+
+	delete(c.fake.keys, applicationKeyId)
+	return nil
+}
+
+func (c *fakeB2Client) ListKeys(_ context.Context) ([]*b2Key, error) {
+	c.fake.mu.Lock()
+	defer c.fake.mu.Unlock()
+
+	if err := c.authorize("listKeys"); err != nil {
+		return nil, err
+	}
+
+	var keys []*b2Key
+	for _, key := range c.fake.keys {
+		listed := key.b2Key
+		listed.Secret = ""
+		keys = append(keys, &listed)
+	}
+
+	slices.SortFunc(keys, func(a, b *b2Key) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	return keys, nil
+}
+
+// getTestBackendWithFakeB2 returns a backend configured with a root key in
+// a fake B2 account
+func getTestBackendWithFakeB2(tb testing.TB) (*backblazeB2Backend, logical.Storage, *fakeB2) {
+	tb.Helper()
+
+	b, s := getTestBackend(tb)
+	fake := newFakeB2()
+	b.newB2API = fake.newClient
+
+	rootKey, err := fake.addKey("vault-root", b2KeyOptions{
+		Capabilities: append(slices.Clone(rootKeyCapabilities), "listBuckets"),
+	})
+	require.NoError(tb, err)
+
+	err = testConfigCreate(b, s, map[string]interface{}{
+		"application_key_id": rootKey.ID,
+		"application_key":    rootKey.Secret,
+		"skip_verify":        true,
+	})
+	require.NoError(tb, err)
+
+	return b, s, fake
+}
@@ -0,0 +1,153 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/vault/sdk/helper/identitytpl"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// maxKeyNameLength is the longest name B2 accepts for an application key
+const maxKeyNameLength = 100
+
+// invalidKeyNameChars matches what B2 doesn't allow in key names
+var invalidKeyNameChars = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+
+// hasIdentityTemplate reports whether s contains template directives
+// to fill in from the requesting entity
+func hasIdentityTemplate(s string) bool {
+	return strings.Contains(s, "{{")
+}
+
+// validateIdentityTemplate checks a template is well formed and only
+// refers to the requesting entity and its groups
+func validateIdentityTemplate(tmpl string) error {
+	_, _, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+		String:            tmpl,
+		ValidityCheckOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = forEachDirective(tmpl, func(directive string) (string, error) {
+		name := strings.TrimSpace(strings.Trim(directive, "{}"))
+		if !strings.HasPrefix(name, "identity.entity.") && !strings.HasPrefix(name, "identity.groups.") {
+			return "", fmt.Errorf("unsupported template %s", directive)
+		}
+
+		return "", nil
+	})
+
+	return err
+}
+
+// renderIdentityTemplate fills in each directive in tmpl for the given
+// entity, passing every value through check before it is used
+func renderIdentityTemplate(tmpl string, entity *logical.Entity, groups []*logical.Group,
+	check func(string) (string, error)) (string, error) {
+
+	if err := validateIdentityTemplate(tmpl); err != nil {
+		return "", err
+	}
+
+	return forEachDirective(tmpl, func(directive string) (string, error) {
+		_, value, err := identitytpl.PopulateString(identitytpl.PopulateStringInput{
+			String: directive,
+			Entity: entity,
+			Groups: groups,
+			Mode:   identitytpl.ACLTemplating,
+		})
+		if err != nil {
+			return "", fmt.Errorf("unable to render %s: %w", directive, err)
+		}
+
+		value, err = check(value)
+		if err != nil {
+			return "", fmt.Errorf("unable to render %s: %w", directive, err)
+		}
+
+		return value, nil
+	})
+}
+
+// forEachDirective replaces each {{ ... }} directive in tmpl with what
+// render returns for it
+func forEachDirective(tmpl string, render func(directive string) (string, error)) (string, error) {
+	var out strings.Builder
+
+	rest := tmpl
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			out.WriteString(rest)
+			return out.String(), nil
+		}
+
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return "", identitytpl.ErrUnbalancedTemplatingCharacter
+		}
+		end += start + len("}}")
+
+		value, err := render(rest[start:end])
+		if err != nil {
+			return "", err
+		}
+
+		out.WriteString(rest[:start])
+		out.WriteString(value)
+		rest = rest[end:]
+	}
+}
+
+// namePrefixTemplateValue checks a value for a name_prefix template.
+// The prefix is what keeps each entity to its own files, so each value
+// has to be a single, non-empty path segment.
+func namePrefixTemplateValue(value string) (string, error) {
+	switch {
+	case value == "":
+		return "", fmt.Errorf("value is empty")
+	case value == "." || value == "..":
+		return "", fmt.Errorf("value %q is not allowed", value)
+	case strings.ContainsAny(value, `/\`):
+		return "", fmt.Errorf("value %q contains a path separator", value)
+	case strings.IndexFunc(value, unicode.IsControl) >= 0:
+		return "", fmt.Errorf("value %q contains control characters", value)
+	}
+
+	return value, nil
+}
+
+// validateNamePrefixSegments checks each "/"-separated segment of a name
+// prefix with namePrefixTemplateValue. Only the last segment may be empty,
+// for a prefix ending in a slash.
+func validateNamePrefixSegments(prefix string) error {
+	segments := strings.Split(prefix, "/")
+	for i, segment := range segments {
+		if segment == "" && i == len(segments)-1 {
+			continue
+		}
+
+		if _, err := namePrefixTemplateValue(segment); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keyNameTemplateValue makes a value for a key_name_prefix template fit
+// B2's key name rules. Key names only label keys, so characters B2
+// doesn't allow are replaced rather than refused.
+func keyNameTemplateValue(value string) (string, error) {
+	value = strings.Trim(invalidKeyNameChars.ReplaceAllString(value, "-"), "-")
+	if value == "" {
+		return "", fmt.Errorf("value is empty")
+	}
+
+	return value, nil
+}
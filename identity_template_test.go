@@ -0,0 +1,100 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIdentityTemplate(t *testing.T) {
+	for _, tmpl := range []string{
+		"",
+		"logs/",
+		"users/{{identity.entity.name}}/",
+		"{{ identity.entity.metadata.team }}/{{identity.entity.id}}/",
+		"{{identity.groups.names.ops.id}}/",
+	} {
+		require.NoError(t, validateIdentityTemplate(tmpl), tmpl)
+	}
+
+	for _, tmpl := range []string{
+		"users/{{identity.entity.name/",
+		"users/identity.entity.name}}/",
+		"{{time.now}}/",
+	} {
+		require.Error(t, validateIdentityTemplate(tmpl), tmpl)
+	}
+}
+
+func TestRenderIdentityTemplate(t *testing.T) {
+	entity := &logical.Entity{
+		ID:   "entity-id",
+		Name: "alice",
+		Metadata: map[string]string{
+			"team":  "data.eng",
+			"empty": "",
+			"path":  "a/b",
+		},
+	}
+
+	render := func(tmpl string, check func(string) (string, error)) (string, error) {
+		return renderIdentityTemplate(tmpl, entity, nil, check)
+	}
+
+	t.Run("name_prefix", func(t *testing.T) {
+		prefix, err := render("users/{{identity.entity.name}}/", namePrefixTemplateValue)
+		require.NoError(t, err)
+		require.Equal(t, "users/alice/", prefix)
+
+		prefix, err = render("{{identity.entity.metadata.team}}/", namePrefixTemplateValue)
+		require.NoError(t, err)
+		require.Equal(t, "data.eng/", prefix)
+
+		for _, tmpl := range []string{
+			"users/{{identity.entity.metadata.empty}}/",
+			"users/{{identity.entity.metadata.missing}}/",
+			"users/{{identity.entity.metadata.path}}/",
+			"users/{{identity.entity.aliases.missing.name}}/",
+		} {
+			_, err := render(tmpl, namePrefixTemplateValue)
+			require.Error(t, err, tmpl)
+		}
+	})
+
+	t.Run("key_name_prefix", func(t *testing.T) {
+		prefix, err := render("vault-{{identity.entity.metadata.team}}-", keyNameTemplateValue)
+		require.NoError(t, err)
+		require.Equal(t, "vault-data-eng-", prefix)
+
+		_, err = render("vault-{{identity.entity.metadata.empty}}-", keyNameTemplateValue)
+		require.Error(t, err)
+	})
+
+	t.Run("No entity", func(t *testing.T) {
+		_, err := renderIdentityTemplate("{{identity.entity.name}}/", nil, nil, namePrefixTemplateValue)
+		require.Error(t, err)
+	})
+}
+
+func TestValidateNamePrefixSegments(t *testing.T) {
+	for _, prefix := range []string{
+		"",
+		"2024",
+		"2024/",
+		"reports/2024/q1",
+	} {
+		require.NoError(t, validateNamePrefixSegments(prefix), prefix)
+	}
+
+	for _, prefix := range []string{
+		"/",
+		"../logs/",
+		"reports//",
+		"./",
+		`a\b/`,
+		"2024\n/",
+	} {
+		require.Error(t, validateNamePrefixSegments(prefix), prefix)
+	}
+}
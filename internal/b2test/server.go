@@ -0,0 +1,599 @@
+// Package b2test provides an in-process emulator of the parts of the
+// Backblaze B2 native API used by the plugin, for tests which should
+// exercise real HTTP handling without reaching B2.
+package b2test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// apiPathRegex matches the API paths the emulator serves. Everything is
+// served as v3, apart from b2_create_key which is also served as v4 for
+// keys restricted to several buckets.
+var apiPathRegex = regexp.MustCompile(`^/b2api/v([34])/(b2_[a-z_]+)$`)
+
+// Key is an application key held by the emulator
+type Key struct {
+	ID           string
+	Secret       string
+	Name         string
+	Capabilities []string
+
+	// BucketIDs and NamePrefix restrict the key, if set
+	BucketIDs  []string
+	NamePrefix string
+
+	// Expires is zero if the key never expires
+	Expires time.Time
+}
+
+// Bucket is a bucket held by the emulator
+type Bucket struct {
+	ID   string
+	Name string
+}
+
+// Server emulates b2_authorize_account, b2_create_key, b2_list_keys,
+// b2_delete_key and b2_list_buckets for a single account. Point a
+// client's API URL at Server.URL to use it.
+type Server struct {
+	*httptest.Server
+
+	// AccountID is the ID of the emulated account
+	AccountID string
+
+	mu       sync.Mutex
+	keys     map[string]*Key
+	buckets  map[string]*Bucket
+	tokens   map[string]string
+	failures map[string][]apiError
+	requests map[string]int
+	nextID   int
+}
+
+// apiError is the body of a B2 error response
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewServer starts an emulator which is closed when the test finishes
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	s := &Server{
+		AccountID: "b2test-account",
+		keys:      make(map[string]*Key),
+		buckets:   make(map[string]*Bucket),
+		tokens:    make(map[string]string),
+		failures:  make(map[string][]apiError),
+		requests:  make(map[string]int),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	tb.Cleanup(s.Close)
+
+	return s
+}
+
+// AddBucket creates a bucket and returns its ID
+func (s *Server) AddBucket(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.newID("bucket")
+	s.buckets[id] = &Bucket{ID: id, Name: name}
+
+	return id
+}
+
+// AddKey creates an application key, as if made outside of the plugin,
+// and returns it including its secret. ID and Secret are generated if
+// they are empty.
+func (s *Server) AddKey(key Key) Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key.ID == "" {
+		key.ID = s.newID("key")
+	}
+
+	if key.Secret == "" {
+		key.Secret = "secret-" + key.ID
+	}
+
+	key.Capabilities = slices.Clone(key.Capabilities)
+	key.BucketIDs = slices.Clone(key.BucketIDs)
+	s.keys[key.ID] = &key
+
+	return key
+}
+
+// Key returns a copy of an application key, or nil if there is no such key
+func (s *Server) Key(id string) *Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil
+	}
+
+	k := *key
+	k.Capabilities = slices.Clone(key.Capabilities)
+	k.BucketIDs = slices.Clone(key.BucketIDs)
+	return &k
+}
+
+// Keys returns copies of all application keys, ordered by ID
+func (s *Server) Keys() []Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []Key
+	for _, id := range s.sortedKeyIDs() {
+		k := *s.keys[id]
+		k.Capabilities = slices.Clone(k.Capabilities)
+		k.BucketIDs = slices.Clone(k.BucketIDs)
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// Fail makes the next call to api, such as "b2_create_key", fail with the
+// given HTTP status and B2 error code. Calls to Fail queue up.
+func (s *Server) Fail(api string, status int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures[api] = append(s.failures[api], apiError{
+		Status:  status,
+		Code:    code,
+		Message: "b2test: simulated failure",
+	})
+}
+
+// Requests returns how many calls have been made to api
+func (s *Server) Requests(api string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[api]
+}
+
+func (s *Server) newID(kind string) string {
+	s.nextID++
+	return fmt.Sprintf("%s%012d", kind, s.nextID)
+}
+
+func (s *Server) sortedKeyIDs() []string {
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	match := apiPathRegex.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		writeError(w, http.StatusNotFound, "not_found", "unknown path "+r.URL.Path)
+		return
+	}
+
+	version, api := match[1], match[2]
+	if version == "4" && api != "b2_create_key" {
+		writeError(w, http.StatusNotFound, "not_found", "unsupported api "+r.URL.Path)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[api]++
+
+	if failures := s.failures[api]; len(failures) > 0 {
+		s.failures[api] = failures[1:]
+		writeError(w, failures[0].Status, failures[0].Code, failures[0].Message)
+		return
+	}
+
+	if api == "b2_authorize_account" {
+		s.authorizeAccount(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "only POST is supported")
+		return
+	}
+
+	key, ok := s.authorizedKey(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "bad_auth_token", "invalid authorization token")
+		return
+	}
+
+	switch api {
+	case "b2_create_key":
+		s.createKey(w, r, key, version)
+	case "b2_list_keys":
+		s.listKeys(w, r, key)
+	case "b2_delete_key":
+		s.deleteKey(w, r, key)
+	case "b2_list_buckets":
+		s.listBuckets(w, r, key)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "unsupported api "+api)
+	}
+}
+
+// authorizedKey returns the key an authorization token was issued for, as
+// long as it still exists
+func (s *Server) authorizedKey(r *http.Request) (*Key, bool) {
+	id, ok := s.tokens[r.Header.Get("Authorization")]
+	if !ok {
+		return nil, false
+	}
+
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+func (s *Server) authorizeAccount(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "bad_auth_token", "missing basic authorization")
+		return
+	}
+
+	key, exists := s.keys[id]
+	if !exists || key.Secret != secret {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid application key")
+		return
+	}
+
+	if !key.Expires.IsZero() && time.Now().After(key.Expires) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "application key has expired")
+		return
+	}
+
+	token := s.newID("token")
+	s.tokens[token] = id
+
+	storage := map[string]interface{}{
+		"absoluteMinimumPartSize": 5000000,
+		"recommendedPartSize":     100000000,
+		"apiUrl":                  s.URL,
+		"downloadUrl":             s.URL,
+		"s3ApiUrl":                s.URL,
+		"capabilities":            key.Capabilities,
+		"bucketId":                nil,
+		"bucketName":              nil,
+		"namePrefix":              nil,
+	}
+
+	// v3 can only describe keys restricted to a single bucket
+	if len(key.BucketIDs) == 1 {
+		storage["bucketId"] = key.BucketIDs[0]
+		if bucket, ok := s.buckets[key.BucketIDs[0]]; ok {
+			storage["bucketName"] = bucket.Name
+		}
+	}
+
+	if key.NamePrefix != "" {
+		storage["namePrefix"] = key.NamePrefix
+	}
+
+	var expiration interface{}
+	if !key.Expires.IsZero() {
+		expiration = key.Expires.UnixMilli()
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"accountId":                         s.AccountID,
+		"authorizationToken":                token,
+		"applicationKeyExpirationTimestamp": expiration,
+		"apiInfo": map[string]interface{}{
+			"storageApi": storage,
+		},
+	})
+}
+
+// keyNameRegex matches the key names B2 accepts
+var keyNameRegex = regexp.MustCompile(`^[A-Za-z0-9-]{1,100}$`)
+
+func (s *Server) createKey(w http.ResponseWriter, r *http.Request, authorized *Key, version string) {
+	if !hasCapability(w, authorized, "writeKeys") {
+		return
+	}
+
+	var req struct {
+		AccountID    string   `json:"accountId"`
+		Capabilities []string `json:"capabilities"`
+		KeyName      string   `json:"keyName"`
+		ValidSeconds int64    `json:"validDurationInSeconds"`
+		BucketID     string   `json:"bucketId"`
+		BucketIDs    []string `json:"bucketIds"`
+		NamePrefix   string   `json:"namePrefix"`
+	}
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	// v4 takes a list of buckets, v3 a single bucket
+	bucketIDs := req.BucketIDs
+	if version == "3" {
+		bucketIDs = nil
+		if req.BucketID != "" {
+			bucketIDs = []string{req.BucketID}
+		}
+	}
+
+	switch {
+	case !keyNameRegex.MatchString(req.KeyName):
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid keyName")
+		return
+	case len(req.Capabilities) == 0:
+		writeError(w, http.StatusBadRequest, "bad_request", "capabilities must not be empty")
+		return
+	case req.NamePrefix != "" && len(bucketIDs) == 0:
+		writeError(w, http.StatusBadRequest, "bad_request", "namePrefix requires a bucket")
+		return
+	case req.ValidSeconds < 0:
+		writeError(w, http.StatusBadRequest, "bad_request", "validDurationInSeconds must be positive")
+		return
+	}
+
+	for _, id := range bucketIDs {
+		if _, ok := s.buckets[id]; !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid bucket ID "+id)
+			return
+		}
+	}
+
+	key := &Key{
+		ID:           s.newID("key"),
+		Name:         req.KeyName,
+		Capabilities: req.Capabilities,
+		BucketIDs:    bucketIDs,
+		NamePrefix:   req.NamePrefix,
+	}
+	key.Secret = "secret-" + key.ID
+
+	if req.ValidSeconds > 0 {
+		key.Expires = time.Now().Add(time.Duration(req.ValidSeconds) * time.Second)
+	}
+
+	s.keys[key.ID] = key
+
+	writeJSON(w, s.keyResponse(key, true, version))
+}
+
+func (s *Server) listKeys(w http.ResponseWriter, r *http.Request, authorized *Key) {
+	if !hasCapability(w, authorized, "listKeys") {
+		return
+	}
+
+	var req struct {
+		AccountID string `json:"accountId"`
+		MaxCount  int    `json:"maxKeyCount"`
+		StartID   string `json:"startApplicationKeyId"`
+	}
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	if req.MaxCount == 0 {
+		req.MaxCount = 100
+	}
+
+	if req.MaxCount < 1 || req.MaxCount > 10000 {
+		writeError(w, http.StatusBadRequest, "bad_request", "maxKeyCount must be between 1 and 10000")
+		return
+	}
+
+	keys := []map[string]interface{}{}
+	var next interface{}
+	for _, id := range s.sortedKeyIDs() {
+		if id < req.StartID {
+			continue
+		}
+
+		if len(keys) == req.MaxCount {
+			next = id
+			break
+		}
+
+		keys = append(keys, s.keyResponse(s.keys[id], false, "3"))
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"keys":                 keys,
+		"nextApplicationKeyId": next,
+	})
+}
+
+func (s *Server) deleteKey(w http.ResponseWriter, r *http.Request, authorized *Key) {
+	if !hasCapability(w, authorized, "deleteKeys") {
+		return
+	}
+
+	var req struct {
+		ApplicationKeyID string `json:"applicationKeyId"`
+	}
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	key, ok := s.keys[req.ApplicationKeyID]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad_request", "application key does not exist")
+		return
+	}
+
+	delete(s.keys, key.ID)
+
+	writeJSON(w, s.keyResponse(key, false, "3"))
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request, authorized *Key) {
+	if !hasCapability(w, authorized, "listBuckets") {
+		return
+	}
+
+	var req struct {
+		AccountID  string `json:"accountId"`
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	}
+	if !s.decode(w, r, &req) {
+		return
+	}
+
+	// Keys restricted to buckets may only list one of those buckets
+	if len(authorized.BucketIDs) > 0 {
+		allowed := slices.ContainsFunc(authorized.BucketIDs, func(id string) bool {
+			bucket, ok := s.buckets[id]
+			return ok && (req.BucketID == id || req.BucketName == bucket.Name)
+		})
+
+		if !allowed {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "key is restricted to buckets")
+			return
+		}
+	}
+
+	buckets := []map[string]interface{}{}
+	for _, bucket := range s.buckets {
+		if len(authorized.BucketIDs) > 0 && !slices.Contains(authorized.BucketIDs, bucket.ID) {
+			continue
+		}
+
+		if req.BucketID != "" && bucket.ID != req.BucketID {
+			continue
+		}
+
+		if req.BucketName != "" && bucket.Name != req.BucketName {
+			continue
+		}
+
+		buckets = append(buckets, map[string]interface{}{
+			"accountId":      s.AccountID,
+			"bucketId":       bucket.ID,
+			"bucketName":     bucket.Name,
+			"bucketType":     "allPrivate",
+			"bucketInfo":     map[string]string{},
+			"lifecycleRules": []interface{}{},
+			"revision":       1,
+		})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i]["bucketName"].(string) < buckets[j]["bucketName"].(string)
+	})
+
+	writeJSON(w, map[string]interface{}{
+		"buckets": buckets,
+	})
+}
+
+// decode reads a JSON request body, and checks any accountId in it
+func (s *Server) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid JSON body")
+		return false
+	}
+
+	if raw, ok := body["accountId"]; ok {
+		var accountID string
+		if err := json.Unmarshal(raw, &accountID); err != nil || accountID != s.AccountID {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid accountId")
+			return false
+		}
+	}
+
+	data, _ := json.Marshal(body)
+	if err := json.Unmarshal(data, v); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) keyResponse(key *Key, withSecret bool, version string) map[string]interface{} {
+	resp := map[string]interface{}{
+		"accountId":           s.AccountID,
+		"applicationKeyId":    key.ID,
+		"keyName":             key.Name,
+		"capabilities":        key.Capabilities,
+		"namePrefix":          nil,
+		"expirationTimestamp": nil,
+	}
+
+	if withSecret {
+		resp["applicationKey"] = key.Secret
+	}
+
+	// v4 lists a key's buckets, v3 can only describe a single bucket
+	if version == "4" {
+		resp["bucketIds"] = nil
+		if len(key.BucketIDs) > 0 {
+			resp["bucketIds"] = key.BucketIDs
+		}
+	} else {
+		resp["bucketId"] = nil
+		if len(key.BucketIDs) == 1 {
+			resp["bucketId"] = key.BucketIDs[0]
+		}
+	}
+
+	if key.NamePrefix != "" {
+		resp["namePrefix"] = key.NamePrefix
+	}
+
+	if !key.Expires.IsZero() {
+		resp["expirationTimestamp"] = key.Expires.UnixMilli()
+	}
+
+	return resp
+}
+
+func hasCapability(w http.ResponseWriter, key *Key, capability string) bool {
+	if !slices.Contains(key.Capabilities, capability) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "key is missing capability "+capability)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(apiError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	})
+}
@@ -0,0 +1,275 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const capabilitySetStoragePrefix = "capability-sets/"
+
+// builtInCapabilitySets are the capability presets every mount has. Their
+// names can't be used for stored capability sets.
+var builtInCapabilitySets = map[string][]string{
+	"read-only": {
+		"listBuckets", "listFiles", "readFiles", "shareFiles",
+	},
+	"read-write": {
+		"listBuckets", "listFiles", "readFiles", "shareFiles", "writeFiles", "deleteFiles",
+	},
+	"write-only-uploader": {
+		"listBuckets", "writeFiles",
+	},
+	"bucket-admin": {
+		"listBuckets", "readBuckets", "writeBuckets",
+		"readBucketRetentions", "writeBucketRetentions",
+		"readBucketEncryption", "writeBucketEncryption",
+		"readBucketNotifications", "writeBucketNotifications",
+		"readBucketReplications", "writeBucketReplications",
+		"readBucketLogging", "writeBucketLogging",
+	},
+}
+
+type capabilitySetEntry struct {
+	// Capabilities is the list of capabilities the set expands to
+	Capabilities []string `json:"capabilities"`
+
+	// AllowUnknownCapabilities skips checking Capabilities against
+	// the catalog
+	AllowUnknownCapabilities bool `json:"allow_unknown_capabilities"`
+}
+
+// List the defined capability sets
+func (b *backblazeB2Backend) pathCapabilitySets() *framework.Path {
+	return &framework.Path{
+		Pattern:      "capability-sets/?",
+		HelpSynopsis: "List configured capability sets.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathCapabilitySetsList,
+			},
+		},
+	}
+}
+
+// pathCapabilitySetsList lists the built-in and stored capability sets
+func (b *backblazeB2Backend) pathCapabilitySetsList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	sets, err := req.Storage.List(ctx, capabilitySetStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of capability sets: %w", err)
+	}
+
+	for name := range builtInCapabilitySets {
+		sets = append(sets, name)
+	}
+	slices.Sort(sets)
+
+	return logical.ListResponse(sets), nil
+}
+
+// Define the CRUD functions for the capability sets path
+func (b *backblazeB2Backend) pathCapabilitySetsCRUD() *framework.Path {
+	return &framework.Path{
+		Pattern:         "capability-sets/" + framework.GenericNameRegex("name"),
+		HelpSynopsis:    "Configure a named set of capabilities.",
+		HelpDescription: "Roles can reference a capability set with capability_set instead of listing capabilities.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Capability set name",
+				Required:    true,
+			},
+			"capabilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Comma-separated list of capabilities",
+				Required:    true,
+			},
+			"allow_unknown_capabilities": {
+				Type:        framework.TypeBool,
+				Description: "Accept capabilities this plugin doesn't know about, for capabilities added to B2 since it was built",
+			},
+		},
+
+		ExistenceCheck: b.pathCapabilitySetExistsCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathCapabilitySetWrite,
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathCapabilitySetRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathCapabilitySetWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathCapabilitySetDelete,
+			},
+		},
+	}
+}
+
+// pathCapabilitySetExistsCheck checks to see if a stored capability set exists
+func (b *backblazeB2Backend) pathCapabilitySetExistsCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	set, err := b.getStoredCapabilitySet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+
+	return set != nil, nil
+}
+
+// pathCapabilitySetRead reads a built-in or stored capability set
+func (b *backblazeB2Backend) pathCapabilitySetRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	if capabilities, ok := builtInCapabilitySets[name]; ok {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"capabilities":               capabilities,
+				"allow_unknown_capabilities": false,
+				"built_in":                   true,
+			},
+		}, nil
+	}
+
+	set, err := b.getStoredCapabilitySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"capabilities":               set.Capabilities,
+			"allow_unknown_capabilities": set.AllowUnknownCapabilities,
+			"built_in":                   false,
+		},
+	}, nil
+}
+
+// pathCapabilitySetWrite creates/updates a stored capability set. Roles
+// look up their set each time a key is issued, so changes apply to keys
+// issued from then on, while keys already issued keep their capabilities.
+func (b *backblazeB2Backend) pathCapabilitySetWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	if _, ok := builtInCapabilitySets[name]; ok {
+		return logical.ErrorResponse("%q is a built-in capability set and can't be changed", name), nil
+	}
+
+	set, err := b.getStoredCapabilitySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		set = &capabilitySetEntry{}
+	}
+
+	if c, ok := d.GetOk("capabilities"); ok {
+		set.Capabilities = c.([]string)
+	}
+
+	if len(set.Capabilities) == 0 {
+		return logical.ErrorResponse("capabilities must be set"), nil
+	}
+
+	if v, ok := d.GetOk("allow_unknown_capabilities"); ok {
+		set.AllowUnknownCapabilities = v.(bool)
+	}
+
+	if !set.AllowUnknownCapabilities {
+		if err := validateCapabilities(set.Capabilities); err != nil {
+			return logical.ErrorResponse("%s; set allow_unknown_capabilities to use capabilities newer than this plugin", err), nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(capabilitySetStoragePrefix+name, set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, fmt.Errorf("failed to write entry to storage: %w", err)
+	}
+
+	return nil, nil
+}
+
+// pathCapabilitySetDelete deletes a stored capability set, as long as no
+// role uses it
+func (b *backblazeB2Backend) pathCapabilitySetDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	if _, ok := builtInCapabilitySets[name]; ok {
+		return logical.ErrorResponse("%q is a built-in capability set and can't be deleted", name), nil
+	}
+
+	roles, err := req.Storage.List(ctx, "roles/")
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of roles: %w", err)
+	}
+
+	for _, roleName := range roles {
+		role, err := b.getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != nil && role.CapabilitySet == name {
+			return logical.ErrorResponse("capability set %q is used by role %q", name, roleName), nil
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, capabilitySetStoragePrefix+name); err != nil {
+		return nil, fmt.Errorf("failed to delete capability set from storage: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *backblazeB2Backend) getStoredCapabilitySet(ctx context.Context, s logical.Storage, name string) (*capabilitySetEntry, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing capability set name")
+	}
+
+	entry, err := s.Get(ctx, capabilitySetStoragePrefix+name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve capability set %q: %w", name, err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var set capabilitySetEntry
+	if err := entry.DecodeJSON(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode capability set %q: %w", name, err)
+	}
+
+	return &set, nil
+}
+
+// getCapabilitySet returns the capabilities of a built-in or stored
+// capability set, or nil if there is no such set
+func (b *backblazeB2Backend) getCapabilitySet(ctx context.Context, s logical.Storage, name string) ([]string, error) {
+	if capabilities, ok := builtInCapabilitySets[name]; ok {
+		return slices.Clone(capabilities), nil
+	}
+
+	set, err := b.getStoredCapabilitySet(ctx, s, name)
+	if err != nil || set == nil {
+		return nil, err
+	}
+
+	return set.Capabilities, nil
+}
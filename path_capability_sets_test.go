@@ -0,0 +1,201 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuiltInCapabilitySets(t *testing.T) {
+	for name, capabilities := range builtInCapabilitySets {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, validateCapabilities(capabilities))
+		})
+	}
+}
+
+func TestCapabilitySet(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Create Capability Set - invalid", func(t *testing.T) {
+		typeValues := map[string]map[string]interface{}{
+			"Missing capabilities": {},
+			"Unknown capability": {
+				"capabilities": "listFiles,readFile",
+			},
+		}
+		for d, v := range typeValues {
+			t.Run(d, func(t *testing.T) {
+				resp, err := testCapabilitySetWrite(b, s, "readers", v)
+				require.NoError(t, err)
+				require.True(t, resp.IsError())
+			})
+		}
+
+		resp, err := testCapabilitySetWrite(b, s, "read-only", map[string]interface{}{
+			"capabilities": "listFiles",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Capability Set - pass", func(t *testing.T) {
+		resp, err := testCapabilitySetWrite(b, s, "readers", map[string]interface{}{
+			"capabilities": "listFiles,readFiles",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testCapabilitySetWrite(b, s, "future", map[string]interface{}{
+			"capabilities":               "readFutureThings",
+			"allow_unknown_capabilities": true,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Read Capability Sets", func(t *testing.T) {
+		resp, err := testCapabilitySetRead(b, s, "readers")
+		require.NoError(t, err)
+		require.Equal(t, []string{"listFiles", "readFiles"}, resp.Data["capabilities"])
+		require.Equal(t, false, resp.Data["built_in"])
+
+		resp, err = testCapabilitySetRead(b, s, "write-only-uploader")
+		require.NoError(t, err)
+		require.Equal(t, []string{"listBuckets", "writeFiles"}, resp.Data["capabilities"])
+		require.Equal(t, true, resp.Data["built_in"])
+
+		resp, err = testCapabilitySetRead(b, s, "missing")
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("List Capability Sets", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      capabilitySetStoragePrefix,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"bucket-admin", "future", "read-only", "read-write", "readers", "write-only-uploader"}, resp.Data["keys"])
+	})
+
+	t.Run("Roles use capability sets", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"capability_set": "readers",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s, testRoleName)
+		require.NoError(t, err)
+		require.Equal(t, "readers", resp.Data["capability_set"])
+		require.Equal(t, []string{"listFiles", "readFiles"}, resp.Data["capabilities"])
+
+		// Changing the set changes the roles using it
+		resp, err = testCapabilitySetWrite(b, s, "readers", map[string]interface{}{
+			"capabilities": "listFiles",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s, testRoleName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"listFiles"}, resp.Data["capabilities"])
+
+		// Built-in sets, and sets of unknown capabilities, can be used
+		for _, set := range []string{"read-write", "future"} {
+			_, err = testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+				"capability_set": set,
+			})
+			require.NoError(t, err)
+		}
+
+		// Setting capabilities replaces the set
+		_, err = testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"capabilities": "listFiles",
+		})
+		require.NoError(t, err)
+
+		resp, err = testTokenRoleRead(t, b, s, testRoleName)
+		require.NoError(t, err)
+		require.Equal(t, "", resp.Data["capability_set"])
+		require.Equal(t, []string{"listFiles"}, resp.Data["capabilities"])
+	})
+
+	t.Run("Roles with invalid capability sets", func(t *testing.T) {
+		typeValues := map[string]map[string]interface{}{
+			"Unknown set": {
+				"capability_set": "missing",
+			},
+			"Empty set": {
+				"capability_set": "",
+			},
+			"Set and capabilities": {
+				"capability_set": "read-only",
+				"capabilities":   "listFiles",
+			},
+		}
+		for d, v := range typeValues {
+			t.Run(d, func(t *testing.T) {
+				resp, err := testTokenRoleCreate(t, b, s, "invalid", v)
+				require.NoError(t, err)
+				require.True(t, resp.IsError())
+			})
+		}
+	})
+
+	t.Run("Delete Capability Set", func(t *testing.T) {
+		resp, err := testCapabilitySetDelete(b, s, "read-only")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		// Not while a role uses it
+		_, err = testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"capability_set": "readers",
+		})
+		require.NoError(t, err)
+
+		resp, err = testCapabilitySetDelete(b, s, "readers")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		_, err = testTokenRoleDelete(t, b, s, testRoleName)
+		require.NoError(t, err)
+
+		resp, err = testCapabilitySetDelete(b, s, "readers")
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testCapabilitySetRead(b, s, "readers")
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+func testCapabilitySetWrite(b logical.Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      capabilitySetStoragePrefix + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testCapabilitySetRead(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      capabilitySetStoragePrefix + name,
+		Storage:   s,
+	})
+}
+
+func testCapabilitySetDelete(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      capabilitySetStoragePrefix + name,
+		Storage:   s,
+	})
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/automatedrotationutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/rotation"
 )
 
 const configStoragePath = "config"
@@ -14,35 +19,45 @@ const configStoragePath = "config"
 type backblazeB2Config struct {
 	ApplicationKeyId string `json:"application_key_id"`
 	ApplicationKey   string `json:"application_key"`
+
+	// ApiUrl overrides the B2 API endpoint used to authorize the
+	// account, e.g. to point at a B2 compatible test server
+	ApiUrl string `json:"api_url"`
+
+	// ProxyUrl is an optional HTTP proxy to send B2 requests through
+	ProxyUrl string `json:"proxy_url"`
+
+	// CACert is an optional PEM encoded CA certificate bundle used to
+	// verify the B2 endpoint's TLS certificate
+	CACert string `json:"ca_cert"`
+
+	// TLSSkipVerify disables TLS certificate verification
+	TLSSkipVerify bool `json:"tls_skip_verify"`
+
+	// RequestTimeout is how long a request to B2 may take, including
+	// reading the response, zero meaning no limit
+	RequestTimeout time.Duration `json:"request_timeout"`
+
+	// LastRotation is when the root application key was last rotated
+	// by Vault, either manually or on a schedule
+	LastRotation time.Time `json:"last_rotation,omitempty"`
+
+	// NextRotation is when the root application key is next due to be
+	// rotated automatically. It is zero if automated rotation is not
+	// configured.
+	NextRotation time.Time `json:"next_rotation,omitempty"`
+
+	automatedrotationutil.AutomatedRotationParams
 }
 
 // Define the CRU functions for the config path
 func (b *backblazeB2Backend) pathConfigCRUD() *framework.Path {
-	return &framework.Path{
+	p := &framework.Path{
 		Pattern:         "config",
 		HelpSynopsis:    "Configure the Backblaze B2 connection.",
 		HelpDescription: "Use this endpoint to set the Backblaze B2 key id and key.",
 
-		Fields: map[string]*framework.FieldSchema{
-			"application_key_id": {
-				Type:        framework.TypeString,
-				Description: "The Backblaze B2 application key id",
-				Required:    true,
-				DisplayAttrs: &framework.DisplayAttributes{
-					Name:      "Application Key ID",
-					Sensitive: false,
-				},
-			},
-			"application_key": {
-				Type:        framework.TypeString,
-				Description: "The Backblaze B2 application key",
-				Required:    true,
-				DisplayAttrs: &framework.DisplayAttributes{
-					Name:      "Application Key",
-					Sensitive: true,
-				},
-			},
-		},
+		Fields: connectionFields(),
 
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -60,7 +75,80 @@ func (b *backblazeB2Backend) pathConfigCRUD() *framework.Path {
 		},
 		ExistenceCheck: b.pathConfigExistenceCheck,
 	}
+
+	automatedrotationutil.AddAutomatedRotationFields(p.Fields)
+
+	return p
 }
+
+// connectionFields returns the fields describing how to connect to B2,
+// shared by the config and config/connections paths
+func connectionFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"application_key_id": {
+			Type:        framework.TypeString,
+			Description: "The Backblaze B2 application key id",
+			Required:    true,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Application Key ID",
+				Sensitive: false,
+			},
+		},
+		"application_key": {
+			Type:        framework.TypeString,
+			Description: "The Backblaze B2 application key",
+			Required:    true,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name:      "Application Key",
+				Sensitive: true,
+			},
+		},
+		"api_url": {
+			Type:        framework.TypeString,
+			Description: "Optional B2 API URL used to authorize the account. Defaults to the Backblaze production endpoint.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name: "API URL",
+			},
+		},
+		"proxy_url": {
+			Type:        framework.TypeString,
+			Description: "Optional URL of an HTTP proxy to send B2 requests through",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name: "Proxy URL",
+			},
+		},
+		"ca_cert": {
+			Type:        framework.TypeString,
+			Description: "Optional PEM encoded CA certificate bundle used to verify the B2 API TLS certificate",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name: "CA Certificate",
+			},
+		},
+		"tls_skip_verify": {
+			Type:        framework.TypeBool,
+			Description: "Disable verification of the B2 API TLS certificate. Not recommended outside of testing.",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name: "Skip TLS Verification",
+			},
+		},
+		"request_timeout": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Optional limit on how long a request to B2 may take, including reading the response",
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name: "Request Timeout",
+			},
+		},
+		"skip_verify": {
+			Type:        framework.TypeBool,
+			Description: "Skip checking the application key against B2 before saving the configuration",
+			Default:     false,
+			DisplayAttrs: &framework.DisplayAttributes{
+				Name: "Skip Verification",
+			},
+		},
+	}
+}
+
 func (b *backblazeB2Backend) pathConfigExistenceCheck(ctx context.Context, req *logical.Request, _ *framework.FieldData) (bool, error) {
 	out, err := req.Storage.Get(ctx, req.Path)
 	if err != nil {
@@ -81,11 +169,19 @@ func (b *backblazeB2Backend) pathConfigRead(ctx context.Context, req *logical.Re
 		return nil, nil
 	}
 
-	return &logical.Response{
-		Data: map[string]interface{}{
-			"application_key_id": config.ApplicationKeyId,
-		},
-	}, nil
+	configData := config.connectionData()
+	configData["last_rotation_time"] = formatTime(config.LastRotation)
+	configData["next_rotation_time"] = formatTime(config.NextRotation)
+
+	config.PopulateAutomatedRotationData(configData)
+
+	resp := &logical.Response{
+		Data: configData,
+	}
+
+	b.addRootKeyMetadata(ctx, req.Storage, defaultConnectionName, config, resp)
+
+	return resp, nil
 }
 
 // Update the configuration
@@ -104,33 +200,175 @@ func (b *backblazeB2Backend) pathConfigWrite(ctx context.Context, req *logical.R
 		config = new(backblazeB2Config)
 	}
 
-	if applicationKeyID, ok := data.GetOk("application_key_id"); ok {
-		config.ApplicationKeyId = applicationKeyID.(string)
+	if err := config.parseConnectionFields(data); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if applicationKey, ok := data.GetOk("application_key"); ok {
-		config.ApplicationKey = applicationKey.(string)
+	if err := config.ParseAutomatedRotationFields(data); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
 	}
 
-	if config.ApplicationKeyId == "" || config.ApplicationKey == "" {
-		return nil, errors.New("both application_key_id and application_key must be set")
+	if config.RotationWindow != 0 {
+		if err := rotation.DefaultScheduler.ValidateRotationWindow(int(config.RotationWindow.Seconds())); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
 	}
 
-	entry, err := logical.StorageEntryJSON(configStoragePath, config)
-	if err != nil {
-		return nil, err
+	if err := config.scheduleNextRotation(time.Now()); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var warnings []string
+	if !data.Get("skip_verify").(bool) {
+		var errResp *logical.Response
+		errResp, warnings = b.verifyConfig(ctx, config)
+		if errResp != nil {
+			return errResp, nil
+		}
 	}
 
-	if err := req.Storage.Put(ctx, entry); err != nil {
+	if err := b.saveConfig(ctx, req.Storage, config); err != nil {
 		return nil, err
 	}
 
 	// reset the client so the next invocation will pick up the new configuration
 	b.reset()
 
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
+
 	return nil, nil
 }
 
+// parseConnectionFields updates the settings for connecting to B2 from
+// the request data, and checks they are usable
+func (c *backblazeB2Config) parseConnectionFields(data *framework.FieldData) error {
+	if applicationKeyID, ok := data.GetOk("application_key_id"); ok {
+		c.ApplicationKeyId = applicationKeyID.(string)
+	}
+
+	if applicationKey, ok := data.GetOk("application_key"); ok {
+		c.ApplicationKey = applicationKey.(string)
+	}
+
+	if c.ApplicationKeyId == "" || c.ApplicationKey == "" {
+		return errors.New("both application_key_id and application_key must be set")
+	}
+
+	if apiURL, ok := data.GetOk("api_url"); ok {
+		c.ApiUrl = strings.TrimSuffix(strings.TrimSpace(apiURL.(string)), "/")
+	}
+
+	if proxyURL, ok := data.GetOk("proxy_url"); ok {
+		c.ProxyUrl = strings.TrimSpace(proxyURL.(string))
+	}
+
+	if caCert, ok := data.GetOk("ca_cert"); ok {
+		c.CACert = caCert.(string)
+	}
+
+	if tlsSkipVerify, ok := data.GetOk("tls_skip_verify"); ok {
+		c.TLSSkipVerify = tlsSkipVerify.(bool)
+	}
+
+	if requestTimeout, ok := data.GetOk("request_timeout"); ok {
+		c.RequestTimeout = time.Duration(requestTimeout.(int)) * time.Second
+	}
+
+	if c.RequestTimeout < 0 {
+		return errors.New("request_timeout cannot be negative")
+	}
+
+	if c.ApiUrl != "" {
+		if _, err := parseHTTPURL(c.ApiUrl); err != nil {
+			return fmt.Errorf("invalid api_url: %w", err)
+		}
+	}
+
+	// Build the transport once to catch bad proxy and CA settings now
+	// rather than on the next request
+	if _, err := c.newTransport(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// connectionData returns the settings for connecting to B2 for display,
+// leaving out the application key itself
+func (c *backblazeB2Config) connectionData() map[string]interface{} {
+	return map[string]interface{}{
+		"application_key_id": c.ApplicationKeyId,
+		"api_url":            c.ApiUrl,
+		"proxy_url":          c.ProxyUrl,
+		"ca_cert":            c.CACert,
+		"tls_skip_verify":    c.TLSSkipVerify,
+		"request_timeout":    c.RequestTimeout.Seconds(),
+	}
+}
+
+// addRootKeyMetadata adds what B2 reports about a connection's application
+// key to a read response. The stored settings are still returned if B2
+// can't be reached, as that may be exactly what the operator is trying
+// to debug.
+func (b *backblazeB2Backend) addRootKeyMetadata(ctx context.Context, s logical.Storage, name string, c *backblazeB2Config, resp *logical.Response) {
+	metadata, err := b.getRootKeyMetadata(ctx, s, name, c)
+	if err != nil {
+		resp.AddWarning(fmt.Sprintf("unable to fetch application key details from B2: %s", err))
+		return
+	}
+
+	resp.Data["account_id"] = metadata.AccountId
+	resp.Data["application_key_name"] = metadata.Name
+	resp.Data["capabilities"] = metadata.Capabilities
+	resp.Data["bucket_id"] = metadata.BucketId
+	resp.Data["bucket_name"] = metadata.BucketName
+	resp.Data["name_prefix"] = metadata.NamePrefix
+	resp.Data["expiration_time"] = formatTime(metadata.KeyExpiration)
+}
+
+// verifyConfig authorizes the configured application key with B2 and makes
+// sure it can manage keys. It returns an error response if the key can't be
+// used, along with warnings about anything that may cause surprises later.
+func (b *backblazeB2Backend) verifyConfig(ctx context.Context, config *backblazeB2Config) (*logical.Response, []string) {
+	info, err := b.getAccountInfo(ctx, config)
+	if err != nil {
+		return logical.ErrorResponse("unable to verify application key with B2, set skip_verify to save anyway: %s", err), nil
+	}
+
+	var missing []string
+	for _, capability := range rootKeyCapabilities {
+		if !slices.Contains(info.Capabilities, capability) {
+			missing = append(missing, capability)
+		}
+	}
+
+	if len(missing) > 0 {
+		resp := logical.ErrorResponse("application key is missing required capabilities: %s", strings.Join(missing, ", "))
+		resp.Data["data"] = map[string]interface{}{
+			"missing_capabilities": missing,
+		}
+		return resp, nil
+	}
+
+	var warnings []string
+
+	if info.BucketId != "" {
+		warnings = append(warnings, fmt.Sprintf("application key is restricted to bucket %q, keys can only be issued for that bucket", info.BucketName))
+	}
+
+	if !info.KeyExpiration.IsZero() {
+		warnings = append(warnings, fmt.Sprintf("application key expires at %s, configure rotation or replace it before then", info.KeyExpiration.Format(time.RFC3339)))
+	}
+
+	if !slices.Contains(info.Capabilities, "listBuckets") {
+		warnings = append(warnings, "application key is missing the listBuckets capability, roles restricted to a bucket will not work")
+	}
+
+	return nil, warnings
+}
+
 func (b *backblazeB2Backend) pathConfigDelete(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
 	err := req.Storage.Delete(ctx, configStoragePath)
 
@@ -158,3 +396,71 @@ func (b *backblazeB2Backend) getConfig(ctx context.Context, s logical.Storage) (
 
 	return config, nil
 }
+
+func (b *backblazeB2Backend) saveConfig(ctx context.Context, s logical.Storage, config *backblazeB2Config) error {
+	entry, err := logical.StorageEntryJSON(configStoragePath, config)
+	if err != nil {
+		return fmt.Errorf("failed to generate JSON configuration: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to persist configuration: %w", err)
+	}
+
+	return nil
+}
+
+// rotationSchedule converts the automated rotation settings into the
+// form understood by the SDK scheduler
+func (c *backblazeB2Config) rotationSchedule() (*rotation.RotationSchedule, error) {
+	rs := &rotation.RotationSchedule{
+		RotationSchedule:  c.RotationSchedule,
+		RotationWindow:    c.RotationWindow,
+		RotationPeriod:    c.RotationPeriod,
+		NextVaultRotation: c.NextRotation,
+		LastVaultRotation: c.LastRotation,
+	}
+
+	if c.RotationSchedule != "" {
+		schedule, err := rotation.DefaultScheduler.Parse(c.RotationSchedule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rotation_schedule: %w", err)
+		}
+		rs.Schedule = schedule
+	}
+
+	return rs, nil
+}
+
+// scheduleNextRotation works out when the root application key is next
+// due for automated rotation. Periods are counted from the last rotation
+// if there was one, schedules from now.
+func (c *backblazeB2Config) scheduleNextRotation(now time.Time) error {
+	if c.DisableAutomatedRotation || !c.ShouldRegisterRotationJob() {
+		c.NextRotation = time.Time{}
+		return nil
+	}
+
+	rs, err := c.rotationSchedule()
+	if err != nil {
+		return err
+	}
+
+	from := now
+	if rotation.DefaultScheduler.UsesTTL(rs) && !c.LastRotation.IsZero() {
+		from = c.LastRotation
+	}
+
+	c.NextRotation = rotation.DefaultScheduler.NextRotationTimeFromInput(rs, from)
+
+	return nil
+}
+
+// formatTime formats a timestamp for output, leaving unset times empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
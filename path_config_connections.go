@@ -0,0 +1,261 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// defaultConnectionName refers to the connection set up at the
+	// config path, used by roles which don't name a connection
+	defaultConnectionName = ""
+
+	connectionStoragePrefix = "config/connections/"
+)
+
+// List the defined connections
+func (b *backblazeB2Backend) pathConnections() *framework.Path {
+	return &framework.Path{
+		Pattern:      "config/connections/?",
+		HelpSynopsis: "List configured Backblaze B2 connections.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathConnectionsList,
+			},
+		},
+	}
+}
+
+// pathConnectionsList lists the currently defined connections
+func (b *backblazeB2Backend) pathConnectionsList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	connections, err := req.Storage.List(ctx, connectionStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of connections: %w", err)
+	}
+
+	return logical.ListResponse(connections), nil
+}
+
+// Define the CRUD functions for the connections path
+func (b *backblazeB2Backend) pathConnectionsCRUD() *framework.Path {
+	p := &framework.Path{
+		Pattern:         "config/connections/" + framework.GenericNameRegex("name"),
+		HelpSynopsis:    "Configure a named Backblaze B2 connection.",
+		HelpDescription: "Use this endpoint to set the Backblaze B2 key id and key for an additional account. Roles select it with their connection parameter.",
+
+		Fields: connectionFields(),
+
+		ExistenceCheck: b.pathConfigExistenceCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathConnectionRead,
+			},
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathConnectionWrite,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathConnectionWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathConnectionDelete,
+			},
+		},
+	}
+
+	p.Fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeString,
+		Description: "Connection name",
+		Required:    true,
+	}
+
+	return p
+}
+
+// pathConnectionRead reads a connection's settings
+func (b *backblazeB2Backend) pathConnectionRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	c, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: c.connectionData(),
+	}
+
+	b.addRootKeyMetadata(ctx, req.Storage, name, c, resp)
+
+	return resp, nil
+}
+
+// pathConnectionWrite creates/updates a connection
+func (b *backblazeB2Backend) pathConnectionWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	c, err := b.getConnection(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if c == nil {
+		c = new(backblazeB2Config)
+	}
+
+	if err := c.parseConnectionFields(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	var warnings []string
+	if !d.Get("skip_verify").(bool) {
+		var errResp *logical.Response
+		errResp, warnings = b.verifyConfig(ctx, c)
+		if errResp != nil {
+			return errResp, nil
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(connectionStoragePrefix+name, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, fmt.Errorf("failed to write entry to storage: %w", err)
+	}
+
+	// reset the client so the next invocation will pick up the new configuration
+	b.resetConnection(name)
+
+	if len(warnings) > 0 {
+		return &logical.Response{Warnings: warnings}, nil
+	}
+
+	return nil, nil
+}
+
+// pathConnectionDelete deletes a connection, as long as no role, static
+// role or library set uses it, and no key issued through it is leased
+func (b *backblazeB2Backend) pathConnectionDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	roles, err := req.Storage.List(ctx, "roles/")
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of roles: %w", err)
+	}
+
+	for _, roleName := range roles {
+		role, err := b.getRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != nil && role.Connection == name {
+			return logical.ErrorResponse("connection %q is used by role %q", name, roleName), nil
+		}
+	}
+
+	staticRoles, err := req.Storage.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of static roles: %w", err)
+	}
+
+	for _, roleName := range staticRoles {
+		role, err := b.getStaticRole(ctx, req.Storage, roleName)
+		if err != nil {
+			return nil, err
+		}
+
+		if role != nil && role.Connection == name {
+			return logical.ErrorResponse("connection %q is used by static role %q", name, roleName), nil
+		}
+	}
+
+	sets, err := req.Storage.List(ctx, libraryStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of library sets: %w", err)
+	}
+
+	for _, setName := range sets {
+		set, err := b.getLibrarySet(ctx, req.Storage, setName)
+		if err != nil {
+			return nil, err
+		}
+
+		if set == nil {
+			continue
+		}
+
+		if set.Connection == name {
+			return logical.ErrorResponse("connection %q is used by library set %q", name, setName), nil
+		}
+
+		for _, key := range set.Keys {
+			if key.Connection == name {
+				return logical.ErrorResponse("connection %q holds keys of library set %q", name, setName), nil
+			}
+		}
+	}
+
+	// Leases revoke their keys through the connection they were issued
+	// from, even if the role has since moved to another
+	issued, err := req.Storage.List(ctx, issuedKeyStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of issued keys: %w", err)
+	}
+
+	now := time.Now()
+	for _, id := range issued {
+		key, err := b.getIssuedKey(ctx, req.Storage, id)
+		if err != nil {
+			return nil, err
+		}
+
+		// A lease which has expired no longer needs the connection
+		if key != nil && key.Connection == name && !key.expired(now) {
+			return logical.ErrorResponse("connection %q holds key %q issued for role %q", name, id, key.Role), nil
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, connectionStoragePrefix+name); err != nil {
+		return nil, fmt.Errorf("failed to delete connection from storage: %w", err)
+	}
+
+	b.resetConnection(name)
+
+	return nil, nil
+}
+
+// getConnection returns the configuration for a named connection, or the
+// mount's default configuration for defaultConnectionName
+func (b *backblazeB2Backend) getConnection(ctx context.Context, s logical.Storage, name string) (*backblazeB2Config, error) {
+	if name == defaultConnectionName {
+		return b.getConfig(ctx, s)
+	}
+
+	entry, err := s.Get(ctx, connectionStoragePrefix+name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve connection %q: %w", name, err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	c := new(backblazeB2Config)
+	if err := entry.DecodeJSON(c); err != nil {
+		return nil, fmt.Errorf("unable to decode connection %q: %w", name, err)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,205 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnections(t *testing.T) {
+	b, s := getTestBackend(t)
+	offline := newOfflineB2Server(t)
+
+	t.Run("Create Connections - pass", func(t *testing.T) {
+		for _, name := range []string{"prod", "staging"} {
+			resp, err := testConnectionWrite(b, s, name, map[string]interface{}{
+				"application_key_id": name + "-key-id",
+				"application_key":    name + "-key",
+				"api_url":            offline.URL,
+				"skip_verify":        true,
+			})
+			require.NoError(t, err)
+			require.Nil(t, resp)
+		}
+	})
+
+	t.Run("Create Connection - missing key", func(t *testing.T) {
+		resp, err := testConnectionWrite(b, s, "backups", map[string]interface{}{
+			"application_key_id": "backups-key-id",
+			"skip_verify":        true,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("List Connections", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "config/connections/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"prod", "staging"}, resp.Data["keys"])
+	})
+
+	t.Run("Read Connection", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "config/connections/prod",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "prod-key-id", resp.Data["application_key_id"])
+		require.Equal(t, offline.URL, resp.Data["api_url"])
+		require.NotContains(t, resp.Data, "application_key")
+	})
+
+	t.Run("Create Role - unknown connection", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"connection":   "missing",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Create Role - with connection", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"connection":   "prod",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s, testRoleName)
+		require.NoError(t, err)
+		require.Equal(t, "prod", resp.Data["connection"])
+	})
+
+	t.Run("Delete Connection - in use", func(t *testing.T) {
+		resp, err := testConnectionDelete(b, s, "prod")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Delete Connection - issued keys", func(t *testing.T) {
+		_, err := testTokenRoleDelete(t, b, s, testRoleName)
+		require.NoError(t, err)
+
+		err = b.saveIssuedKey(context.Background(), s, "issued-key", &issuedKey{
+			Role:       testRoleName,
+			Connection: "prod",
+		})
+		require.NoError(t, err)
+
+		resp, err := testConnectionDelete(b, s, "prod")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		require.NoError(t, s.Delete(context.Background(), issuedKeyStoragePrefix+"issued-key"))
+	})
+
+	t.Run("Delete Connection - pass", func(t *testing.T) {
+		// A key whose lease has expired doesn't hold the connection
+		err := b.saveIssuedKey(context.Background(), s, "expired-key", &issuedKey{
+			Role:       testRoleName,
+			Connection: "prod",
+			ExpireTime: time.Now().Add(-time.Hour),
+		})
+		require.NoError(t, err)
+
+		resp, err := testConnectionDelete(b, s, "prod")
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		c, err := b.getConnection(context.Background(), s, "prod")
+		require.NoError(t, err)
+		require.Nil(t, c)
+	})
+}
+
+func TestConnectionClients(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	newServer := func(requests *atomic.Int32) *httptest.Server {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			_, _ = fmt.Fprintf(w, `{"accountId": "account", "authorizationToken": "token", "apiInfo": {"storageApi": {"apiUrl": %q}}}`, server.URL)
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	var defaultRequests, prodRequests atomic.Int32
+	defaultServer := newServer(&defaultRequests)
+	prodServer := newServer(&prodRequests)
+
+	err := testConfigCreate(b, s, map[string]interface{}{
+		"application_key_id": applicationKeyID,
+		"application_key":    applicationKey,
+		"api_url":            defaultServer.URL,
+		"skip_verify":        true,
+	})
+	require.NoError(t, err)
+
+	_, err = testConnectionWrite(b, s, "prod", map[string]interface{}{
+		"application_key_id": applicationKeyID,
+		"application_key":    applicationKey,
+		"api_url":            prodServer.URL,
+		"skip_verify":        true,
+	})
+	require.NoError(t, err)
+
+	defaultClient, err := b.getB2Client(context.Background(), s)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), defaultRequests.Load())
+	require.Equal(t, int32(0), prodRequests.Load())
+
+	prodClient, err := b.getConnectionClient(context.Background(), s, "prod")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), prodRequests.Load())
+	require.NotSame(t, defaultClient, prodClient)
+
+	// Cached clients are reused until their connection changes
+	_, err = b.getConnectionClient(context.Background(), s, "prod")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), prodRequests.Load())
+
+	b.invalidate(context.Background(), connectionStoragePrefix+"prod")
+
+	_, err = b.getB2Client(context.Background(), s)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), defaultRequests.Load())
+
+	_, err = b.getConnectionClient(context.Background(), s, "prod")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), prodRequests.Load())
+
+	_, err = b.getConnectionClient(context.Background(), s, "missing")
+	require.Error(t, err)
+}
+
+func testConnectionWrite(b logical.Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      connectionStoragePrefix + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testConnectionDelete(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      connectionStoragePrefix + name,
+		Storage:   s,
+	})
+}
@@ -2,11 +2,17 @@ package vault_plugin_secrets_backblazeb2
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
-	b2client "github.com/Backblaze/blazer/b2"
+	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/rotation"
+	"github.com/mitchellh/mapstructure"
 )
 
 // Define the rotate path
@@ -15,6 +21,13 @@ func (b *backblazeB2Backend) pathConfigRotate() *framework.Path {
 		Pattern:         "config/rotate-root",
 		HelpSynopsis:    "Use the existing application key to generate a set a new application key",
 		HelpDescription: "Use this endpoint to use the current application key to generate a new application key, and use that",
+		Fields: map[string]*framework.FieldSchema{
+			"capabilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Optional comma-separated list of capabilities for the new application key. Defaults to the capabilities of the current key.",
+				Required:    false,
+			},
+		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.UpdateOperation: &framework.PathOperation{
 				Callback: b.pathConfigRotateRootUpdate,
@@ -24,83 +37,411 @@ func (b *backblazeB2Backend) pathConfigRotate() *framework.Path {
 }
 
 // Rotate the key
-func (b *backblazeB2Backend) pathConfigRotateRootUpdate(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+func (b *backblazeB2Backend) pathConfigRotateRootUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	var capabilities []string
+	if c, ok := d.GetOk("capabilities"); ok {
+		capabilities = c.([]string)
 
-	// Get the current b.client before we blow it away
-	client, err := b.getB2Client(ctx, req.Storage)
-	if err != nil {
+		// Refuse to rotate to a key that couldn't manage keys,
+		// as the mount would be unusable afterwards
+		for _, required := range rootKeyCapabilities {
+			if !slices.Contains(capabilities, required) {
+				return logical.ErrorResponse("capabilities must include %s", strings.Join(rootKeyCapabilities, ", ")), nil
+			}
+		}
+	}
+
+	if err := b.rotateRootCredentials(ctx, req.Storage, capabilities); err != nil {
 		return nil, err
 	}
 
+	return nil, nil
+}
+
+// rotateRootIfDue is called periodically and rotates the root
+// application key once its scheduled rotation time has passed
+func (b *backblazeB2Backend) rotateRootIfDue(ctx context.Context, s logical.Storage) error {
+	c, err := b.getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if c == nil || c.DisableAutomatedRotation || c.NextRotation.IsZero() {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Before(c.NextRotation) {
+		return nil
+	}
+
+	rs, err := c.rotationSchedule()
+	if err != nil {
+		return err
+	}
+
+	// If Vault was unavailable for the whole rotation window, skip this
+	// slot and wait for the next one rather than rotating at an
+	// unexpected time
+	if !rotation.DefaultScheduler.IsInsideRotationWindow(rs, now) {
+		c.NextRotation = rotation.DefaultScheduler.NextRotationTimeFromInput(rs, now)
+		b.Logger().Warn("Missed root rotation window, rescheduling", "next_rotation", c.NextRotation)
+		return b.saveConfig(ctx, s, c)
+	}
+
+	b.Logger().Info("Rotating root application key on schedule")
+	return b.rotateRootCredentials(ctx, s, nil)
+}
+
+// rootKeyCapabilities are the capabilities the root application key
+// needs to manage keys on behalf of the mount
+var rootKeyCapabilities = []string{"listKeys", "writeKeys", "deleteKeys"}
+
+// rootRotationWALKind is the WAL entry kind written while the root
+// application key is being rotated
+const rootRotationWALKind = "rootRotation"
+
+// rootRotationWAL records an in-flight root rotation so that it can be
+// completed or undone if Vault stops part way through
+type rootRotationWAL struct {
+	keyReplacementWAL `mapstructure:",squash"`
+}
+
+// rotateRootCredentials uses the current application key to create a new
+// one, switches the mount over to it and deletes the old key. The new key
+// has the same bucket and name prefix restrictions as the old one, and the
+// same capabilities unless different ones are given.
+func (b *backblazeB2Backend) rotateRootCredentials(ctx context.Context, s logical.Storage, capabilities []string) error {
+	b.rootRotationLock.Lock()
+	defer b.rootRotationLock.Unlock()
+
+	client, err := b.getB2Client(ctx, s)
+	if err != nil {
+		return err
+	}
+
 	// Fetch configuration
-	c, err := b.getConfig(ctx, req.Storage)
+	c, err := b.getConfig(ctx, s)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// Save the old ApplicationKeyId so we can destroy it
-	oldApplicationKeyId := c.ApplicationKeyId
+	if c == nil {
+		return fmt.Errorf("backend is not configured")
+	}
 
 	// Look up the old key to get the key name
-	oldKeys, _, err := b.client.ListKeys(ctx, 1, oldApplicationKeyId)
+	oldKey, err := client.GetKey(ctx, c.ApplicationKeyId)
 	if err != nil {
 		b.Logger().Error("Error looking up previous application key", "error", err)
-		return nil, fmt.Errorf("failed to look up previous application key: %w", err)
+		return fmt.Errorf("failed to look up previous application key: %w", err)
+	}
+
+	if oldKey == nil {
+		return fmt.Errorf("failed to look up previous application key: key %q not found", c.ApplicationKeyId)
+	}
+
+	// blazer's key listing, which GetKey relies on, leaves out a key's
+	// capabilities and bucket and name prefix restrictions, but
+	// authorizing with the key returns them
+	oldKeyInfo, err := client.AccountInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to look up previous application key restrictions: %w", err)
+	}
+
+	if len(capabilities) == 0 {
+		capabilities = oldKeyInfo.Capabilities
+	}
+
+	// Create new key, restricted to the same bucket as the old one
+	opts := b2KeyOptions{Capabilities: capabilities}
+	if oldKeyInfo.BucketId != "" {
+		opts.BucketIDs = []string{oldKeyInfo.BucketId}
+		opts.NamePrefix = oldKeyInfo.NamePrefix
+	}
+
+	// and expiring when the old one would have. B2 takes the lifetime
+	// in whole seconds.
+	if !oldKeyInfo.KeyExpiration.IsZero() {
+		opts.Lifetime = time.Until(oldKeyInfo.KeyExpiration)
+		if opts.Lifetime < time.Second {
+			return fmt.Errorf("previous application key %q has expired", c.ApplicationKeyId)
+		}
+	}
+
+	wal := &rootRotationWAL{keyReplacementWAL{
+		OldConnection:       defaultConnectionName,
+		OldApplicationKeyId: c.ApplicationKeyId,
+		NewConnection:       defaultConnectionName,
+		NewKeyName:          oldKey.Name,
+	}}
+
+	create := func() (*b2Key, error) {
+		return client.CreateKey(ctx, oldKey.Name, opts)
 	}
 
-	if len(oldKeys) != 1 {
-		return nil, fmt.Errorf("failed to look up previous application key: expected 1 key, got %d", len(oldKeys))
+	store := func(newKey *b2Key) error {
+		c.ApplicationKeyId = newKey.ID
+		c.ApplicationKey = newKey.Secret
+
+		now := time.Now()
+		c.LastRotation = now
+		if err := c.scheduleNextRotation(now); err != nil {
+			return err
+		}
+
+		if err := b.saveConfig(ctx, s, c); err != nil {
+			return err
+		}
+
+		// Replace client
+		b.reset()
+		if _, err := b.getB2Client(ctx, s); err != nil {
+			return fmt.Errorf("failed to create new b2client: %w", err)
+		}
+
+		return nil
 	}
 
-	oldKeyName := oldKeys[0].Name()
+	return b.replaceKey(ctx, s, rootRotationWALKind, wal, false, create, store)
+}
+
+// rootRotationRollback finishes or undoes a root rotation that was
+// interrupted
+func (b *backblazeB2Backend) rootRotationRollback(ctx context.Context, req *logical.Request, data interface{}) error {
+	var entry rootRotationWAL
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
 
-	// Set new key options
-	var opts []b2client.KeyOption
-	opts = append(opts, b2client.Capabilities("listKeys", "writeKeys", "deleteKeys"))
+	b.rootRotationLock.Lock()
+	defer b.rootRotationLock.Unlock()
 
-	// Create new key
-	newKey, err := client.CreateKey(ctx, oldKeyName, opts...)
+	c, err := b.getConfig(ctx, req.Storage)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// Without configuration there's no way to reach B2, and
+	// nothing left for us to manage
+	if c == nil {
+		return nil
 	}
 
-	c.ApplicationKeyId = newKey.ID()
-	c.ApplicationKey = newKey.Secret()
+	return b.rollbackKeyReplacement(ctx, req.Storage, b.Logger().With("kind", rootRotationWALKind), &entry.keyReplacementWAL, func(id string) bool {
+		return c.ApplicationKeyId == id
+	})
+}
+
+// keyReplacementWAL is embedded in the WAL entries written while one of
+// the mount's application keys is replaced by another. There is no old key
+// when a key is first added and no new one when a key is only removed, and
+// the two may belong to different connections.
+type keyReplacementWAL struct {
+	OldConnection       string `json:"old_connection" mapstructure:"old_connection"`
+	OldApplicationKeyId string `json:"old_application_key_id" mapstructure:"old_application_key_id"`
+	NewConnection       string `json:"new_connection" mapstructure:"new_connection"`
+	NewApplicationKeyId string `json:"new_application_key_id" mapstructure:"new_application_key_id"`
+
+	// NewKeyName and ExistingKeyIds find the new key if Vault stops
+	// before its ID is recorded
+	NewKeyName     string   `json:"new_key_name" mapstructure:"new_key_name"`
+	ExistingKeyIds []string `json:"existing_key_ids" mapstructure:"existing_key_ids"`
+}
+
+func (w *keyReplacementWAL) replacement() *keyReplacementWAL {
+	return w
+}
+
+// keyReplacementEntry is a WAL entry which embeds a keyReplacementWAL
+type keyReplacementEntry interface {
+	replacement() *keyReplacementWAL
+}
+
+// replaceKey writes entry to the WAL, creates the new key with create,
+// hands it to store to be put into use, deletes the old key and finally
+// deletes the WAL entry. If Vault stops part way through, the entry lets
+// rollbackKeyReplacement finish or undo the job. A nil create removes the
+// old key without replacing it, and store is passed nil. Unless no other
+// key can share the new key's name, the keys which already have it are
+// recorded, so the new key can be told apart from them.
+func (b *backblazeB2Backend) replaceKey(ctx context.Context, s logical.Storage, kind string, entry keyReplacementEntry, uniqueName bool,
+	create func() (*b2Key, error), store func(newKey *b2Key) error) error {
+	wal := entry.replacement()
+
+	if create != nil && !uniqueName {
+		client, err := b.getConnectionClient(ctx, s, wal.NewConnection)
+		if err != nil {
+			return err
+		}
+
+		if wal.ExistingKeyIds, err = keyIDsNamed(ctx, client, wal.NewKeyName); err != nil {
+			return err
+		}
+	}
+
+	// Record the replacement before creating the key, so a crash from
+	// here on can be cleaned up by walRollback
+	walID, err := framework.PutWAL(ctx, s, kind, entry)
+	if err != nil {
+		return fmt.Errorf("failed to write WAL entry: %w", err)
+	}
+
+	var newKey *b2Key
+	if create != nil {
+		// B2 may have created the key even if the request failed, so the
+		// WAL entry is left for the rollback to look for it
+		if newKey, err = create(); err != nil {
+			return fmt.Errorf("failed to create application key: %w", err)
+		}
+
+		wal.NewApplicationKeyId = newKey.ID
+		if walID, err = b.updateWAL(ctx, s, walID, kind, entry); err != nil {
+			b.deleteUnusedKey(ctx, s, wal.NewConnection, newKey.ID)
+			return fmt.Errorf("failed to write WAL entry: %w", err)
+		}
+	}
+
+	if err := store(newKey); err != nil {
+		// The new key was never put into use. If we can't delete it now,
+		// leave the WAL entry in place so the rollback retries later.
+		if newKey == nil || b.deleteUnusedKey(ctx, s, wal.NewConnection, newKey.ID) {
+			b.deleteWAL(ctx, s, walID)
+		}
+		return err
+	}
+
+	// On failure the WAL entry is kept, and the rollback will finish
+	// the job
+	if wal.OldApplicationKeyId != "" {
+		b.Logger().Info("Deleting previous key", "kind", kind, "id", wal.OldApplicationKeyId)
+		if err := b.deleteKey(ctx, s, wal.OldConnection, wal.OldApplicationKeyId); err != nil {
+			b.Logger().Error("Error deleting old key", "error", err)
+			return fmt.Errorf("error deleting old key: %w", err)
+		}
+	}
+
+	b.deleteWAL(ctx, s, walID)
+
+	return nil
+}
+
+// rollbackKeyReplacement finishes or undoes a key replacement that was
+// interrupted. holds reports whether the key's owner, such as a role or
+// the mount's configuration, holds the key with the given ID. If it holds
+// the new key, the old one is deleted. If it still holds the old key, the
+// new one never made it into use and is deleted instead. If it holds
+// neither, both are deleted.
+func (b *backblazeB2Backend) rollbackKeyReplacement(ctx context.Context, s logical.Storage, logger hclog.Logger, wal *keyReplacementWAL, holds func(applicationKeyId string) bool) error {
+	switch {
+	case wal.NewApplicationKeyId != "" && holds(wal.NewApplicationKeyId):
+		logger.Info("Completing interrupted key replacement, deleting previous key", "id", wal.OldApplicationKeyId)
+		return b.deleteKey(ctx, s, wal.OldConnection, wal.OldApplicationKeyId)
+	case wal.OldApplicationKeyId != "" && holds(wal.OldApplicationKeyId):
+		logger.Info("Rolling back interrupted key replacement, deleting unused key", "id", wal.NewApplicationKeyId)
+		return b.deleteNewKey(ctx, s, logger, wal, holds)
+	default:
+		logger.Info("Cleaning up interrupted key replacement, deleting both keys", "old_id", wal.OldApplicationKeyId, "new_id", wal.NewApplicationKeyId)
+		return errors.Join(
+			b.deleteNewKey(ctx, s, logger, wal, holds),
+			b.deleteKey(ctx, s, wal.OldConnection, wal.OldApplicationKeyId),
+		)
+	}
+}
+
+// deleteNewKey deletes the new key of an interrupted key replacement. If
+// Vault stopped before the key's ID was recorded, the keys with its name
+// are deleted instead, except those which existed before the replacement
+// and those the key's owner holds. Each key deleted that way is logged, as
+// nothing else records which keys were matched.
+func (b *backblazeB2Backend) deleteNewKey(ctx context.Context, s logical.Storage, logger hclog.Logger, wal *keyReplacementWAL, holds func(applicationKeyId string) bool) error {
+	if wal.NewApplicationKeyId != "" || wal.NewKeyName == "" {
+		return b.deleteKey(ctx, s, wal.NewConnection, wal.NewApplicationKeyId)
+	}
 
-	// Make a new storage entry
-	entry, err := logical.StorageEntryJSON(configStoragePath, c)
+	client, err := b.getConnectionClient(ctx, s, wal.NewConnection)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate JSON configuration: %w", err)
+		return err
+	}
+
+	ids, err := keyIDsNamed(ctx, client, wal.NewKeyName)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if slices.Contains(wal.ExistingKeyIds, id) || id == wal.OldApplicationKeyId || holds(id) {
+			continue
+		}
+
+		logger.Info("Deleting unused application key found by name", "id", id, "name", wal.NewKeyName)
+		if err := client.DeleteKey(ctx, id); err != nil {
+			return err
+		}
 	}
 
-	b.reset()
+	return nil
+}
 
-	// And store it
-	if err := req.Storage.Put(ctx, entry); err != nil {
-		return nil, fmt.Errorf("failed to persist configuration: %w", err)
+// deleteKey deletes a key using the given connection. An empty ID is
+// ignored.
+func (b *backblazeB2Backend) deleteKey(ctx context.Context, s logical.Storage, connection string, applicationKeyId string) error {
+	if applicationKeyId == "" {
+		return nil
 	}
 
-	// Replace client
-	client, err = b.getB2Client(ctx, req.Storage)
+	client, err := b.getConnectionClient(ctx, s, connection)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new b2client: %w", err)
+		return err
 	}
-	b.client = client
 
-	// Destroy old key
-	b.Logger().Info("Deleting previous key", "id", oldApplicationKeyId)
+	return client.DeleteKey(ctx, applicationKeyId)
+}
 
-	// We *should* only get one, and *should* only get the
-	// one we asked for, but be safe
-	for _, key := range oldKeys {
-		b.Logger().Debug("Deleting old key, examining", "ID", key.ID())
-		if key.ID() == oldApplicationKeyId {
-			if err = key.Delete(ctx); err != nil {
-				b.Logger().Error("Error deleting old key", "error", err)
-				return nil, fmt.Errorf("error deleting old key: %w", err)
-			}
+// deleteUnusedKey makes a best effort attempt to delete a newly created
+// key which could not be put into use, and reports whether it succeeded
+func (b *backblazeB2Backend) deleteUnusedKey(ctx context.Context, s logical.Storage, connection string, applicationKeyId string) bool {
+	if err := b.deleteKey(ctx, s, connection, applicationKeyId); err != nil {
+		b.Logger().Error("Error deleting unused application key", "id", applicationKeyId, "error", err)
+		return false
+	}
+
+	return true
+}
+
+// updateWAL replaces a WAL entry with one holding data, and returns the
+// ID of the new entry. The old entry is only deleted once the new one is
+// written.
+func (b *backblazeB2Backend) updateWAL(ctx context.Context, s logical.Storage, walID string, kind string, data interface{}) (string, error) {
+	newWALID, err := framework.PutWAL(ctx, s, kind, data)
+	if err != nil {
+		return walID, err
+	}
+
+	b.deleteWAL(ctx, s, walID)
+
+	return newWALID, nil
+}
+
+func (b *backblazeB2Backend) deleteWAL(ctx context.Context, s logical.Storage, walID string) {
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		b.Logger().Warn("Error deleting WAL entry, it will be cleaned up by the rollback", "id", walID, "error", err)
+	}
+}
+
+// keyIDsNamed returns the IDs of the keys in B2 with the given name
+func keyIDsNamed(ctx context.Context, client b2API, name string) ([]string, error) {
+	keys, err := client.ListKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list application keys: %w", err)
+	}
+
+	var ids []string
+	for _, key := range keys {
+		if key.Name == name {
+			ids = append(ids, key.ID)
 		}
 	}
 
-	return nil, nil
+	return ids, nil
 }
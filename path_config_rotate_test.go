@@ -2,12 +2,16 @@ package vault_plugin_secrets_backblazeb2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
-	b2client "github.com/Backblaze/blazer/b2"
+	"github.com/hashicorp/vault/sdk/framework"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPathConfigRotateRoot(t *testing.T) {
@@ -21,20 +25,25 @@ func TestPathConfigRotateRoot(t *testing.T) {
 		envVarBackblazeB2ApplicationKey,
 	)
 
-	client, err := b2client.NewClient(context.Background(), os.Getenv(envVarBackblazeB2ApplicationKeyID), os.Getenv(envVarBackblazeB2ApplicationKey))
+	client, err := newBlazerClient(context.Background(), &backblazeB2Config{
+		ApplicationKeyId: os.Getenv(envVarBackblazeB2ApplicationKeyID),
+		ApplicationKey:   os.Getenv(envVarBackblazeB2ApplicationKey),
+	})
 
 	if err != nil {
 		t.Fatalf("Unable to create b2 client: %s", err)
 	}
 
-	key, err := client.CreateKey(context.Background(), "test-rotation-key", b2client.Capabilities("listKeys", "writeKeys", "deleteKeys"))
+	key, err := client.CreateKey(context.Background(), "test-rotation-key", b2KeyOptions{
+		Capabilities: []string{"listKeys", "writeKeys", "deleteKeys"},
+	})
 
 	if err != nil {
 		t.Fatalf("Unable to create test rotation key: %s", err)
 	}
 
 	defer func() {
-		err := key.Delete(context.Background())
+		err := client.DeleteKey(context.Background(), key.ID)
 		if err != nil {
 			t.Errorf("Unable to delete test rotation key: %s", err)
 		}
@@ -43,8 +52,8 @@ func TestPathConfigRotateRoot(t *testing.T) {
 	b, s := getTestBackend(t)
 
 	configData := map[string]interface{}{
-		"application_key_id": key.ID(),
-		"application_key":    key.Secret(),
+		"application_key_id": key.ID,
+		"application_key":    key.Secret,
 	}
 
 	err = testConfigCreate(b, s, configData)
@@ -76,7 +85,7 @@ func TestPathConfigRotateRoot(t *testing.T) {
 		t.Fatal(fmt.Errorf("application key id was empty after rotate root, it shouldn't be"))
 	}
 
-	if config.ApplicationKeyId == key.ID() {
+	if config.ApplicationKeyId == key.ID {
 		t.Fatal("old and new application key ids are equal after rotate-root, it shouldn't be")
 	}
 
@@ -84,16 +93,349 @@ func TestPathConfigRotateRoot(t *testing.T) {
 		t.Fatal("application key is empty, it shouldn't be")
 	}
 
-	if config.ApplicationKey == key.Secret() {
+	if config.ApplicationKey == key.Secret {
 		t.Fatal("old and new application keys are equal after rotate-root, it shouldn't be")
 	}
 
-	keys, _, err := client.ListKeys(context.Background(), 1, config.ApplicationKeyId)
-	for _, currentKey := range keys {
-		if currentKey.ID() == config.ApplicationKeyId {
-			if err = currentKey.Delete(context.Background()); err != nil {
-				t.Errorf("Unable to delete rotated key: %s", err)
-			}
+	defer func() {
+		if err := client.DeleteKey(context.Background(), config.ApplicationKeyId); err != nil {
+			t.Errorf("Unable to delete rotated key: %s", err)
 		}
+	}()
+
+	info, err := b.getAccountInfo(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	require.ElementsMatch(t, key.Capabilities, info.Capabilities)
+}
+
+func TestPathConfigRotateRootCapabilities(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	err := testConfigCreate(b, s, map[string]interface{}{
+		"application_key_id": applicationKeyID,
+		"application_key":    applicationKey,
+		"skip_verify":        true,
+	})
+	require.NoError(t, err)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config/rotate-root",
+		Data: map[string]interface{}{
+			"capabilities": "listKeys,writeKeys",
+		},
+		Storage: s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+	require.True(t, resp.IsError())
+}
+
+// failingStorage wraps a storage backend and fails any write to keys
+// starting with failPutPrefix
+type failingStorage struct {
+	logical.Storage
+	failPutPrefix string
+}
+
+func (s *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if s.failPutPrefix != "" && strings.HasPrefix(entry.Key, s.failPutPrefix) {
+		return errors.New("simulated storage failure")
+	}
+
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestRootRotationWALRollback(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Unknown WAL kind", func(t *testing.T) {
+		err := b.walRollback(context.Background(), &logical.Request{Storage: s}, "unknown", nil)
+		require.Error(t, err)
+	})
+
+	t.Run("No configuration", func(t *testing.T) {
+		walID, err := framework.PutWAL(context.Background(), s, rootRotationWALKind, &rootRotationWAL{keyReplacementWAL{
+			OldApplicationKeyId: "old",
+			NewApplicationKeyId: "new",
+		}})
+		require.NoError(t, err)
+
+		entry, err := framework.GetWAL(context.Background(), s, walID)
+		require.NoError(t, err)
+
+		err = b.walRollback(context.Background(), &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		require.NoError(t, err)
+	})
+}
+
+func TestRotateRootCredentials(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Preserves key restrictions", func(t *testing.T) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+		bucketID := fake.addBucket("backups")
+
+		key, err := fake.addKey("restricted-root", b2KeyOptions{
+			Capabilities: []string{"listKeys", "writeKeys", "deleteKeys", "readFiles"},
+			BucketIDs:    []string{bucketID},
+			NamePrefix:   "vault/",
+			Lifetime:     24 * time.Hour,
+		})
+		require.NoError(t, err)
+
+		err = testConfigUpdate(b, s, map[string]interface{}{
+			"application_key_id": key.ID,
+			"application_key":    key.Secret,
+			"skip_verify":        true,
+		})
+		require.NoError(t, err)
+
+		err = b.rotateRootCredentials(ctx, s, nil)
+		require.NoError(t, err)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		require.NotEqual(t, key.ID, config.ApplicationKeyId)
+		require.Nil(t, fake.key(key.ID))
+
+		rotated := fake.key(config.ApplicationKeyId)
+		require.NotNil(t, rotated)
+		require.Equal(t, config.ApplicationKey, rotated.Secret)
+		require.Equal(t, "restricted-root", rotated.Name)
+		require.ElementsMatch(t, []string{"listKeys", "writeKeys", "deleteKeys", "readFiles"}, rotated.Capabilities)
+		require.Equal(t, []string{bucketID}, rotated.BucketIDs)
+		require.Equal(t, "vault/", rotated.NamePrefix)
+		require.WithinDuration(t, key.Expires, rotated.Expires, 2*time.Second)
+		require.False(t, config.LastRotation.IsZero())
+
+		// The mount keeps working with the new key
+		_, err = b.b2ApplicationKeyCreate(ctx, s, "vault-test", backblazeB2RoleEntry{
+			Capabilities: []string{"readFiles"},
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("New capabilities", func(t *testing.T) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+
+		err := b.rotateRootCredentials(ctx, s, []string{"listKeys", "writeKeys", "deleteKeys", "listBuckets", "readBuckets"})
+		require.NoError(t, err)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		require.ElementsMatch(t, []string{"listKeys", "writeKeys", "deleteKeys", "listBuckets", "readBuckets"}, fake.key(config.ApplicationKeyId).Capabilities)
+	})
+
+	t.Run("Expired key", func(t *testing.T) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		fake.keys[config.ApplicationKeyId].Expires = time.Now().Add(-time.Minute)
+
+		err = b.rotateRootCredentials(ctx, s, nil)
+		require.Error(t, err)
+		require.Len(t, fake.keys, 1)
+	})
+
+	t.Run("Key creation fails", func(t *testing.T) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+		fake.createErr = errors.New("simulated B2 failure")
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+
+		err = b.rotateRootCredentials(ctx, s, nil)
+		require.Error(t, err)
+
+		after, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, config.ApplicationKeyId, after.ApplicationKeyId)
+		require.Len(t, fake.keys, 1)
+
+		// The WAL entry is kept in case B2 created the key anyway, and
+		// the rollback finds nothing to delete
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, ids, 1)
+
+		entry, err := framework.GetWAL(ctx, s, ids[0])
+		require.NoError(t, err)
+		require.NoError(t, b.walRollback(ctx, &logical.Request{Storage: s}, entry.Kind, entry.Data))
+		require.NotNil(t, fake.key(config.ApplicationKeyId))
+	})
+}
+
+func TestPathConfigRotateRootFailures(t *testing.T) {
+	ctx := context.Background()
+
+	requireKeyExists := func(t *testing.T, fake *fakeB2, id string, exists bool) {
+		require.Equal(t, exists, fake.key(id) != nil, "existence of key %s", id)
+	}
+
+	setup := func(t *testing.T) (*backblazeB2Backend, *failingStorage, *fakeB2, string) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+
+		return b, &failingStorage{Storage: s}, fake, config.ApplicationKeyId
+	}
+
+	newRootKey := func(t *testing.T, fake *fakeB2) *b2Key {
+		key, err := fake.addKey("test-rotation-key", b2KeyOptions{
+			Capabilities: rootKeyCapabilities,
+		})
+		require.NoError(t, err)
+
+		return key
 	}
+
+	rollback := func(t *testing.T, b *backblazeB2Backend, s logical.Storage) {
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, ids, 1)
+
+		entry, err := framework.GetWAL(ctx, s, ids[0])
+		require.NoError(t, err)
+
+		err = b.walRollback(ctx, &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		require.NoError(t, err)
+	}
+
+	t.Run("WAL write fails", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+		s.failPutPrefix = "wal/"
+
+		err := b.rotateRootCredentials(ctx, s, nil)
+		require.Error(t, err)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, keyID, config.ApplicationKeyId)
+		requireKeyExists(t, fake, keyID, true)
+		require.Len(t, fake.keys, 1)
+
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, ids)
+	})
+
+	t.Run("Config write fails", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+		s.failPutPrefix = configStoragePath
+
+		err := b.rotateRootCredentials(ctx, s, nil)
+		require.Error(t, err)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		require.Equal(t, keyID, config.ApplicationKeyId)
+		requireKeyExists(t, fake, keyID, true)
+		require.Len(t, fake.keys, 1)
+
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, ids)
+	})
+
+	t.Run("Old key delete fails", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+		fake.deleteErr = errors.New("simulated B2 failure")
+
+		err := b.rotateRootCredentials(ctx, s, nil)
+		require.Error(t, err)
+
+		config, err := b.getConfig(ctx, s)
+		require.NoError(t, err)
+		require.NotEqual(t, keyID, config.ApplicationKeyId)
+		requireKeyExists(t, fake, keyID, true)
+
+		// The WAL entry is kept, and the rollback finishes the rotation
+		fake.deleteErr = nil
+		rollback(t, b, s)
+
+		requireKeyExists(t, fake, keyID, false)
+		requireKeyExists(t, fake, config.ApplicationKeyId, true)
+	})
+
+	t.Run("Crash before key ID is recorded", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+
+		earlier := newRootKey(t, fake)
+		_, err := framework.PutWAL(ctx, s, rootRotationWALKind, &rootRotationWAL{keyReplacementWAL{
+			OldApplicationKeyId: keyID,
+			NewKeyName:          earlier.Name,
+			ExistingKeyIds:      []string{earlier.ID},
+		}})
+		require.NoError(t, err)
+		halfCreated := newRootKey(t, fake)
+
+		rollback(t, b, s)
+
+		requireKeyExists(t, fake, keyID, true)
+		requireKeyExists(t, fake, earlier.ID, true)
+		requireKeyExists(t, fake, halfCreated.ID, false)
+	})
+
+	t.Run("Crash before key ID is recorded keeps the configured key", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+
+		name := fake.key(keyID).Name
+		_, err := framework.PutWAL(ctx, s, rootRotationWALKind, &rootRotationWAL{keyReplacementWAL{
+			OldApplicationKeyId: keyID,
+			NewKeyName:          name,
+		}})
+		require.NoError(t, err)
+		halfCreated, err := fake.addKey(name, b2KeyOptions{Capabilities: rootKeyCapabilities})
+		require.NoError(t, err)
+
+		rollback(t, b, s)
+
+		requireKeyExists(t, fake, keyID, true)
+		requireKeyExists(t, fake, halfCreated.ID, false)
+	})
+
+	t.Run("Crash before config is written", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+
+		halfCreated := newRootKey(t, fake)
+		_, err := framework.PutWAL(ctx, s, rootRotationWALKind, &rootRotationWAL{keyReplacementWAL{
+			OldApplicationKeyId: keyID,
+			NewApplicationKeyId: halfCreated.ID,
+		}})
+		require.NoError(t, err)
+
+		rollback(t, b, s)
+
+		requireKeyExists(t, fake, keyID, true)
+		requireKeyExists(t, fake, halfCreated.ID, false)
+	})
+
+	t.Run("Crash before old key is deleted", func(t *testing.T) {
+		b, s, fake, keyID := setup(t)
+
+		rotated := newRootKey(t, fake)
+		_, err := framework.PutWAL(ctx, s, rootRotationWALKind, &rootRotationWAL{keyReplacementWAL{
+			OldApplicationKeyId: keyID,
+			NewApplicationKeyId: rotated.ID,
+		}})
+		require.NoError(t, err)
+
+		err = testConfigUpdate(b, s, map[string]interface{}{
+			"application_key_id": rotated.ID,
+			"application_key":    rotated.Secret,
+			"skip_verify":        true,
+		})
+		require.NoError(t, err)
+
+		rollback(t, b, s)
+
+		requireKeyExists(t, fake, keyID, false)
+		requireKeyExists(t, fake, rotated.ID, true)
+	})
 }
@@ -2,11 +2,17 @@ package vault_plugin_secrets_backblazeb2
 
 import (
 	"context"
+	"encoding/pem"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -16,6 +22,7 @@ const (
 
 func TestConfig(t *testing.T) {
 	b, reqStorage := getTestBackend(t)
+	offline := newOfflineB2Server(t)
 
 	t.Run("Test Configuration", func(t *testing.T) {
 
@@ -47,13 +54,26 @@ func TestConfig(t *testing.T) {
 			err := testConfigCreate(b, reqStorage, map[string]interface{}{
 				"application_key_id": applicationKeyID,
 				"application_key":    applicationKey,
+				"api_url":            offline.URL,
+				"skip_verify":        true,
 			})
 			assert.NoError(t, err)
 		})
 
 		t.Run("Read Configuration - pass", func(t *testing.T) {
 			err := testConfigRead(b, reqStorage, map[string]interface{}{
-				"application_key_id": applicationKeyID,
+				"application_key_id":         applicationKeyID,
+				"api_url":                    offline.URL,
+				"proxy_url":                  "",
+				"ca_cert":                    "",
+				"tls_skip_verify":            false,
+				"request_timeout":            float64(0),
+				"last_rotation_time":         "",
+				"next_rotation_time":         "",
+				"rotation_schedule":          "",
+				"rotation_window":            float64(0),
+				"rotation_period":            float64(0),
+				"disable_automated_rotation": false,
 			})
 			assert.NoError(t, err)
 		})
@@ -62,13 +82,25 @@ func TestConfig(t *testing.T) {
 			err := testConfigUpdate(b, reqStorage, map[string]interface{}{
 				"application_key_id": "updated_application_key_id",
 				"application_key":    "updated_application_key",
+				"skip_verify":        true,
 			})
 			assert.NoError(t, err)
 		})
 
 		t.Run("Read Updated Configuration - pass", func(t *testing.T) {
 			err := testConfigRead(b, reqStorage, map[string]interface{}{
-				"application_key_id": "updated_application_key_id",
+				"application_key_id":         "updated_application_key_id",
+				"api_url":                    offline.URL,
+				"proxy_url":                  "",
+				"ca_cert":                    "",
+				"tls_skip_verify":            false,
+				"request_timeout":            float64(0),
+				"last_rotation_time":         "",
+				"next_rotation_time":         "",
+				"rotation_schedule":          "",
+				"rotation_window":            float64(0),
+				"rotation_period":            float64(0),
+				"disable_automated_rotation": false,
 			})
 			assert.NoError(t, err)
 		})
@@ -80,6 +112,343 @@ func TestConfig(t *testing.T) {
 	})
 }
 
+func TestConfigConnection(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+
+	typeValues := map[string]map[string]interface{}{
+		"Invalid api_url scheme":   {"api_url": "ftp://example.com"},
+		"Invalid api_url host":     {"api_url": "https://"},
+		"Invalid proxy_url":        {"proxy_url": "not a url"},
+		"Invalid ca_cert":          {"ca_cert": "not a certificate"},
+		"Negative request_timeout": {"request_timeout": -1},
+	}
+	for d, v := range typeValues {
+		t.Run("Create Configuration - "+d, func(t *testing.T) {
+			data := map[string]interface{}{
+				"application_key_id": applicationKeyID,
+				"application_key":    applicationKey,
+			}
+			for k, val := range v {
+				data[k] = val
+			}
+
+			err := testConfigCreate(b, reqStorage, data)
+			assert.Error(t, err)
+		})
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"accountId": "account-1", "apiInfo": {"storageApi": {"capabilities": ["listKeys"]}}}`))
+	}))
+	defer server.Close()
+
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	t.Run("Create Configuration - pass", func(t *testing.T) {
+		err := testConfigCreate(b, reqStorage, map[string]interface{}{
+			"application_key_id": applicationKeyID,
+			"application_key":    applicationKey,
+			"skip_verify":        true,
+			"api_url":            server.URL + "/",
+			"proxy_url":          "http://proxy.example.com:3128",
+			"ca_cert":            caCert,
+			"request_timeout":    "30s",
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configStoragePath,
+			Storage:   reqStorage,
+		})
+		require.NoError(t, err)
+		require.Equal(t, server.URL, resp.Data["api_url"])
+		require.Equal(t, "http://proxy.example.com:3128", resp.Data["proxy_url"])
+		require.Equal(t, caCert, resp.Data["ca_cert"])
+		require.Equal(t, float64(30), resp.Data["request_timeout"])
+	})
+
+	t.Run("Authorize against api_url with ca_cert", func(t *testing.T) {
+		err := testConfigUpdate(b, reqStorage, map[string]interface{}{
+			"skip_verify": true,
+			"proxy_url":   "",
+		})
+		require.NoError(t, err)
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+
+		info, err := b.getAccountInfo(context.Background(), config)
+		require.NoError(t, err)
+		require.Equal(t, "account-1", info.AccountId)
+	})
+
+	t.Run("Authorize against api_url without ca_cert", func(t *testing.T) {
+		err := testConfigUpdate(b, reqStorage, map[string]interface{}{
+			"skip_verify": true,
+			"ca_cert":     "",
+		})
+		require.NoError(t, err)
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+
+		_, err = b.getAccountInfo(context.Background(), config)
+		require.Error(t, err)
+	})
+}
+
+func TestConfigVerify(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+
+	var authResponse string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, secret, _ := r.BasicAuth(); secret != applicationKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"status": 401, "code": "unauthorized", "message": "invalid key"}`))
+			return
+		}
+		_, _ = w.Write([]byte(authResponse))
+	}))
+	defer server.Close()
+
+	configRequest := func(key string) *logical.Request {
+		return &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      configStoragePath,
+			Data: map[string]interface{}{
+				"application_key_id": applicationKeyID,
+				"application_key":    key,
+				"api_url":            server.URL,
+			},
+			Storage: reqStorage,
+		}
+	}
+
+	t.Run("Create Configuration - invalid key", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), configRequest("wrong"))
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "invalid key")
+	})
+
+	t.Run("Create Configuration - invalid key with skip_verify", func(t *testing.T) {
+		req := configRequest("wrong")
+		req.Data["skip_verify"] = true
+
+		resp, err := b.HandleRequest(context.Background(), req)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		require.NoError(t, testConfigDelete(b, reqStorage))
+	})
+
+	t.Run("Create Configuration - missing capabilities", func(t *testing.T) {
+		authResponse = `{"accountId": "account-1", "apiInfo": {"storageApi": {"capabilities": ["listKeys", "listBuckets"]}}}`
+
+		resp, err := b.HandleRequest(context.Background(), configRequest(applicationKey))
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Equal(t, []string{"writeKeys", "deleteKeys"}, resp.Data["data"].(map[string]interface{})["missing_capabilities"])
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		require.Nil(t, config)
+	})
+
+	t.Run("Create Configuration - restricted key", func(t *testing.T) {
+		authResponse = `{"accountId": "account-1", "apiInfo": {"storageApi": {
+			"capabilities": ["listKeys", "writeKeys", "deleteKeys"],
+			"bucketId": "bucket-1",
+			"bucketName": "my-bucket"
+		}}}`
+
+		resp, err := b.HandleRequest(context.Background(), configRequest(applicationKey))
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.False(t, resp.IsError())
+		require.Len(t, resp.Warnings, 2)
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		require.NotNil(t, config)
+	})
+}
+
+func TestConfigReadRootKeyMetadata(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+
+	var requests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		switch r.URL.Path {
+		case "/b2api/v3/b2_authorize_account":
+			_, _ = fmt.Fprintf(w, `{
+				"accountId": "account-1",
+				"authorizationToken": "token",
+				"applicationKeyExpirationTimestamp": 1700000000000,
+				"apiInfo": {"storageApi": {
+					"apiUrl": %q,
+					"capabilities": ["listKeys", "writeKeys", "deleteKeys", "listBuckets"],
+					"bucketId": "bucket-1",
+					"bucketName": "my-bucket",
+					"namePrefix": "logs/"
+				}}
+			}`, server.URL)
+		case "/b2api/v3/b2_list_keys":
+			_, _ = fmt.Fprintf(w, `{"keys": [{"applicationKeyId": %q, "keyName": "vault-root"}]}`, applicationKeyID)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	err := testConfigCreate(b, reqStorage, map[string]interface{}{
+		"application_key_id": applicationKeyID,
+		"application_key":    applicationKey,
+		"api_url":            server.URL,
+		"skip_verify":        true,
+	})
+	require.NoError(t, err)
+
+	readConfig := func(t *testing.T) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configStoragePath,
+			Storage:   reqStorage,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp)
+		require.Empty(t, resp.Warnings)
+
+		return resp
+	}
+
+	t.Run("Read Configuration - metadata", func(t *testing.T) {
+		resp := readConfig(t)
+		require.Equal(t, "account-1", resp.Data["account_id"])
+		require.Equal(t, "vault-root", resp.Data["application_key_name"])
+		require.Equal(t, []string{"listKeys", "writeKeys", "deleteKeys", "listBuckets"}, resp.Data["capabilities"])
+		require.Equal(t, "bucket-1", resp.Data["bucket_id"])
+		require.Equal(t, "my-bucket", resp.Data["bucket_name"])
+		require.Equal(t, "logs/", resp.Data["name_prefix"])
+		require.Equal(t, time.UnixMilli(1700000000000).Format(time.RFC3339), resp.Data["expiration_time"])
+	})
+
+	t.Run("Read Configuration - cached", func(t *testing.T) {
+		before := requests.Load()
+		readConfig(t)
+		require.Equal(t, before, requests.Load())
+	})
+
+	t.Run("Read Configuration - cache reset on write", func(t *testing.T) {
+		err := testConfigUpdate(b, reqStorage, map[string]interface{}{
+			"request_timeout": 10,
+			"skip_verify":     true,
+		})
+		require.NoError(t, err)
+
+		before := requests.Load()
+		readConfig(t)
+		require.Greater(t, requests.Load(), before)
+	})
+}
+
+func TestConfigAutomatedRotation(t *testing.T) {
+	b, reqStorage := getTestBackend(t)
+	offline := newOfflineB2Server(t)
+
+	t.Run("Create Configuration - schedule and period", func(t *testing.T) {
+		err := testConfigCreate(b, reqStorage, map[string]interface{}{
+			"application_key_id": applicationKeyID,
+			"application_key":    applicationKey,
+			"rotation_schedule":  "0 * * * *",
+			"rotation_period":    3600,
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Create Configuration - rotation window too short", func(t *testing.T) {
+		err := testConfigCreate(b, reqStorage, map[string]interface{}{
+			"application_key_id": applicationKeyID,
+			"application_key":    applicationKey,
+			"rotation_schedule":  "0 * * * *",
+			"rotation_window":    60,
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("Create Configuration - rotation period", func(t *testing.T) {
+		err := testConfigCreate(b, reqStorage, map[string]interface{}{
+			"application_key_id": applicationKeyID,
+			"application_key":    applicationKey,
+			"skip_verify":        true,
+			"rotation_period":    86400,
+			"api_url":            offline.URL,
+		})
+		require.NoError(t, err)
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		require.Equal(t, 24*time.Hour, config.RotationPeriod)
+		require.WithinDuration(t, time.Now().Add(24*time.Hour), config.NextRotation, time.Minute)
+		require.True(t, config.LastRotation.IsZero())
+	})
+
+	t.Run("Periodic rotation - not due", func(t *testing.T) {
+		err := b.rotateRootIfDue(context.Background(), reqStorage)
+		require.NoError(t, err)
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		require.Equal(t, applicationKeyID, config.ApplicationKeyId)
+	})
+
+	t.Run("Update Configuration - missed rotation window", func(t *testing.T) {
+		err := testConfigUpdate(b, reqStorage, map[string]interface{}{
+			"skip_verify":       true,
+			"rotation_period":   0,
+			"rotation_schedule": "0 0 * * *",
+			"rotation_window":   3600,
+		})
+		require.NoError(t, err)
+
+		config, err := b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+
+		config.NextRotation = time.Now().Add(-2 * time.Hour)
+		require.NoError(t, b.saveConfig(context.Background(), reqStorage, config))
+
+		err = b.rotateRootIfDue(context.Background(), reqStorage)
+		require.NoError(t, err)
+
+		config, err = b.getConfig(context.Background(), reqStorage)
+		require.NoError(t, err)
+		require.Equal(t, applicationKeyID, config.ApplicationKeyId)
+		require.True(t, config.NextRotation.After(time.Now()))
+	})
+
+	t.Run("Update Configuration - disable automated rotation", func(t *testing.T) {
+		err := testConfigUpdate(b, reqStorage, map[string]interface{}{
+			"skip_verify":                true,
+			"disable_automated_rotation": true,
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      configStoragePath,
+			Storage:   reqStorage,
+		})
+		require.NoError(t, err)
+		require.Equal(t, "0 0 * * *", resp.Data["rotation_schedule"])
+		require.Equal(t, true, resp.Data["disable_automated_rotation"])
+		require.Equal(t, "", resp.Data["next_rotation_time"])
+	})
+}
+
 func testConfigCreate(b logical.Backend, s logical.Storage, d map[string]interface{}) error {
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.CreateOperation,
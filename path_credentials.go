@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/hashicorp/vault/sdk/framework"
@@ -20,16 +23,36 @@ func (b *backblazeB2Backend) pathCredentials() *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of role",
 			},
+			"capabilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Optional comma-separated list of capabilities for the key, which must be some of the role's capabilities",
+			},
+			"name_prefix": {
+				Type:        framework.TypeString,
+				Description: "Optional name prefix for the key, which must start with the role's name_prefix",
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Optional TTL for the key, no longer than the role's max_ttl",
+			},
+			"format": {
+				Type:        framework.TypeString,
+				Description: "Optional client configuration format returned in config",
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
 				Callback: b.pathKeyRead,
 			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathKeyRead,
+			},
 		},
 	}
 }
 
-// Read a new key
+// Read a new key, optionally narrowed by the request to less than the
+// role allows
 func (b *backblazeB2Backend) pathKeyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 
 	roleName := d.Get("role").(string)
@@ -43,6 +66,48 @@ func (b *backblazeB2Backend) pathKeyRead(ctx context.Context, req *logical.Reque
 		return nil, errors.New("error retrieving role: role is nil")
 	}
 
+	if err := b.resolveCapabilitySet(ctx, req.Storage, role); err != nil {
+		return nil, err
+	}
+
+	// Fill in the role's identity templates for the requesting entity
+	if hasIdentityTemplate(role.KeyNamePrefix) || hasIdentityTemplate(role.NamePrefix) {
+		entity, groups, err := b.requestIdentity(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if entity == nil {
+			return logical.ErrorResponse("role %q uses identity templates, which requires a token with an entity", roleName), nil
+		}
+
+		if err := role.renderTemplates(entity, groups); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	if resp := role.narrow(d); resp != nil {
+		return resp, nil
+	}
+
+	format := d.Get("format").(string)
+	if format != "" {
+		if err := validateCredentialFormat(format); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+	}
+
+	// Look up the endpoints first, so a failure can't leave a key behind
+	client, err := b.getConnectionClient(ctx, req.Storage, role.Connection)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := b.getConnectionAccount(ctx, role.Connection, client)
+	if err != nil {
+		return nil, err
+	}
+
 	name := uuid.New().String()
 	newKeyName := fmt.Sprintf("%s%s", role.KeyNamePrefix, name)
 
@@ -52,14 +117,91 @@ func (b *backblazeB2Backend) pathKeyRead(ctx context.Context, req *logical.Reque
 		return nil, err
 	}
 
+	// Without a record tidy would take the key for an orphan
+	createTime := time.Now()
+	if err := b.saveIssuedKey(ctx, req.Storage, newKey.ID, &issuedKey{
+		Role:        roleName,
+		Connection:  role.Connection,
+		KeyName:     newKey.Name,
+		CreateTime:  createTime,
+		EntityID:    req.EntityID,
+		DisplayName: req.DisplayName,
+		ExpireTime:  b.leaseExpireTime(createTime, role.MaxTTL, newKey.Expires),
+	}); err != nil {
+		return nil, errors.Join(err, client.DeleteKey(ctx, newKey.ID))
+	}
+
 	// Gin up response
-	resp := b.Secret(b2KeyType).Response(map[string]interface{}{
-		"application_key_id": newKey.ID(),
-		"application_key":    newKey.Secret(),
-	}, map[string]interface{}{
-		"application_key_id": newKey.ID(),
+	internal := map[string]interface{}{
+		"application_key_id": newKey.ID,
 		"role":               roleName,
-	})
+		"connection":         role.Connection,
+	}
+
+	// Remember when B2 expires the key, so renewals can't outlive it
+	if !newKey.Expires.IsZero() {
+		internal["expiration"] = formatTime(newKey.Expires)
+	}
+
+	// Renewals keep to a requested TTL rather than the role's
+	if _, ok := d.GetOk("ttl"); ok {
+		internal["ttl"] = role.TTL.String()
+	}
+
+	data := map[string]interface{}{
+		"application_key_id": newKey.ID,
+		"application_key":    newKey.Secret,
+		"api_url":            account.ApiUrl,
+		"download_url":       account.DownloadUrl,
+		"s3_endpoint":        account.S3ApiUrl,
+		"region":             s3Region(account.S3ApiUrl),
+
+		// What the key was granted, as B2 reports it
+		"key_name":        newKey.Name,
+		"capabilities":    newKey.Capabilities,
+		"account_id":      newKey.AccountID,
+		"bucket_name":     "",
+		"bucket_names":    b.cachedBucketNames(role.Connection, newKey.BucketIDs),
+		"bucket_id":       "",
+		"bucket_ids":      newKey.BucketIDs,
+		"name_prefix":     newKey.NamePrefix,
+		"expiration_time": formatTime(newKey.Expires),
+	}
+
+	// Buckets given by ID may not have had their names looked up, and
+	// then their names are empty
+	bucketName := ""
+	if len(newKey.BucketIDs) == 1 {
+		bucketName = data["bucket_names"].([]string)[0]
+		data["bucket_name"] = bucketName
+		data["bucket_id"] = newKey.BucketIDs[0]
+	}
+
+	if format != "" {
+		credentials := renderedCredentials{
+			Name:             roleName,
+			ApplicationKeyID: newKey.ID,
+			ApplicationKey:   newKey.Secret,
+			S3Endpoint:       account.S3ApiUrl,
+			Region:           s3Region(account.S3ApiUrl),
+			BucketName:       bucketName,
+			NamePrefix:       newKey.NamePrefix,
+		}
+
+		config, err := credentials.render(format)
+		if err != nil {
+			return nil, err
+		}
+
+		data["config"] = config
+	}
+
+	if role.AWSCredentialAliases {
+		data["aws_access_key_id"] = newKey.ID
+		data["aws_secret_access_key"] = newKey.Secret
+	}
+
+	resp := b.Secret(b2KeyType).Response(data, internal)
 
 	if role.TTL > 0 {
 		resp.Secret.TTL = role.TTL
@@ -71,3 +213,80 @@ func (b *backblazeB2Backend) pathKeyRead(ctx context.Context, req *logical.Reque
 
 	return resp, nil
 }
+
+// narrow restricts the role to the capabilities, name prefix and TTL the
+// request asks for, returning an error response if they aren't within
+// what the role allows
+func (r *backblazeB2RoleEntry) narrow(d *framework.FieldData) *logical.Response {
+	if capabilitiesRaw, ok := d.GetOk("capabilities"); ok {
+		capabilities := capabilitiesRaw.([]string)
+		if len(capabilities) == 0 {
+			return logical.ErrorResponse("capabilities cannot be empty")
+		}
+
+		for _, capability := range capabilities {
+			if !slices.Contains(r.Capabilities, capability) {
+				return logical.ErrorResponse("capability %q is not allowed by the role", capability)
+			}
+		}
+
+		r.Capabilities = capabilities
+	}
+
+	// An empty name_prefix, or the role's own, leaves the key as it is
+	if namePrefix := d.Get("name_prefix").(string); namePrefix != "" && namePrefix != r.NamePrefix {
+		switch {
+		case len(r.BucketNames) == 0 && len(r.BucketIDs) == 0:
+			return logical.ErrorResponse("name_prefix can only be set if the role restricts keys to buckets")
+		case !strings.HasPrefix(namePrefix, r.NamePrefix):
+			return logical.ErrorResponse("name_prefix must start with the role's name prefix %q", r.NamePrefix)
+		}
+
+		// The segments the caller adds to, or starts, are held to the
+		// same rules as identity template values
+		if err := validateNamePrefixSegments(namePrefix[strings.LastIndex(r.NamePrefix, "/")+1:]); err != nil {
+			return logical.ErrorResponse("invalid name_prefix: %s", err)
+		}
+
+		r.NamePrefix = namePrefix
+	}
+
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		ttl := time.Duration(ttlRaw.(int)) * time.Second
+
+		switch {
+		case ttl <= 0:
+			return logical.ErrorResponse("ttl must be positive")
+		case r.MaxTTL > 0 && ttl > r.MaxTTL:
+			return logical.ErrorResponse("ttl cannot be greater than the role's max_ttl of %s", r.MaxTTL)
+		}
+
+		r.TTL = ttl
+	}
+
+	return nil
+}
+
+// requestIdentity looks up the entity which made the request and its
+// groups, returning a nil entity if there isn't one
+func (b *backblazeB2Backend) requestIdentity(req *logical.Request) (*logical.Entity, []*logical.Group, error) {
+	if req.EntityID == "" {
+		return nil, nil, nil
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error looking up entity: %w", err)
+	}
+
+	if entity == nil {
+		return nil, nil, nil
+	}
+
+	groups, err := b.System().GroupsForEntity(req.EntityID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error looking up entity groups: %w", err)
+	}
+
+	return entity, groups, nil
+}
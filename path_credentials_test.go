@@ -2,13 +2,16 @@ package vault_plugin_secrets_backblazeb2
 
 import (
 	"context"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
 )
 
 func newCloudAcceptanceTestEnv() (*testCloudEnv, error) {
@@ -54,3 +57,655 @@ func TestCloudAcceptanceToken(t *testing.T) {
 	t.Run("verify number of issued tokens", acceptanceTestEnv.VerifyNumberOfIssuedCredentials)
 	t.Run("cleanup creds", acceptanceTestEnv.CleanupCreds)
 }
+
+func TestCredentials(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	fake.addBucket("backups")
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities":    []string{"listFiles", "readFiles"},
+		"key_name_prefix": "vault-test-",
+		"bucket_name":     "backups",
+		"name_prefix":     "logs/",
+		"ttl":             "1h",
+		"max_ttl":         "24h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	var secret *logical.Secret
+
+	t.Run("Read Credentials", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp.Secret)
+		require.Equal(t, time.Hour, resp.Secret.TTL)
+		require.Equal(t, 24*time.Hour, resp.Secret.MaxTTL)
+
+		id := resp.Data["application_key_id"].(string)
+		require.Equal(t, id, resp.Secret.InternalData["application_key_id"])
+		require.Equal(t, testRoleName, resp.Secret.InternalData["role"])
+
+		key := fake.key(id)
+		require.NotNil(t, key)
+		require.Equal(t, key.Secret, resp.Data["application_key"])
+		require.True(t, strings.HasPrefix(key.Name, "vault-test-"))
+		require.Equal(t, []string{"listFiles", "readFiles"}, key.Capabilities)
+		require.Equal(t, []string{"backups"}, key.BucketNames)
+		require.Equal(t, "logs/", key.NamePrefix)
+
+		require.Equal(t, key.Name, resp.Data["key_name"])
+		require.Equal(t, key.Capabilities, resp.Data["capabilities"])
+		require.Equal(t, fake.accountID, resp.Data["account_id"])
+		require.Equal(t, "backups", resp.Data["bucket_name"])
+		require.Equal(t, []string{"backups"}, resp.Data["bucket_names"])
+		require.Equal(t, key.BucketIDs[0], resp.Data["bucket_id"])
+		require.Equal(t, key.BucketIDs, resp.Data["bucket_ids"])
+		require.Equal(t, "logs/", resp.Data["name_prefix"])
+		require.Empty(t, resp.Data["expiration_time"])
+
+		secret = resp.Secret
+	})
+
+	t.Run("Renew Credentials", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"ttl": "2h",
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 2*time.Hour, resp.Secret.TTL)
+		require.Equal(t, 24*time.Hour, resp.Secret.MaxTTL)
+	})
+
+	t.Run("Revoke Credentials", func(t *testing.T) {
+		id := secret.InternalData["application_key_id"].(string)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Nil(t, fake.key(id))
+
+		// The key is deleted by ID without looking it up first
+		require.Zero(t, fake.keyLookups)
+	})
+
+	t.Run("Revoke Credentials - key already deleted", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Zero(t, fake.keyLookups)
+	})
+
+	t.Run("Revoke Credentials - B2 failure", func(t *testing.T) {
+		key, err := fake.addKey("vault-test-other", b2KeyOptions{Capabilities: []string{"listFiles"}})
+		require.NoError(t, err)
+		fake.deleteErr = errors.New("simulated B2 failure")
+		defer func() { fake.deleteErr = nil }()
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"secret_type":        b2KeyType,
+					"application_key_id": key.ID,
+					"role":               testRoleName,
+				},
+			},
+		})
+		require.Error(t, err)
+		require.NotNil(t, fake.key(key.ID))
+	})
+
+	t.Run("Read Credentials - B2 failure", func(t *testing.T) {
+		fake.createErr = errors.New("simulated B2 failure")
+		defer func() { fake.createErr = nil }()
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.Error(t, err)
+	})
+}
+
+func TestCredentialsKeyExpiration(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities":                []string{"listFiles"},
+		"ttl":                         "1h",
+		"max_ttl":                     "4h",
+		"key_expiration":              true,
+		"key_expiration_grace_period": "30m",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + testRoleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+
+	key := fake.key(resp.Data["application_key_id"].(string))
+	require.WithinDuration(t, time.Now().Add(4*time.Hour+30*time.Minute), key.Expires, time.Minute)
+	require.Equal(t, formatTime(key.Expires), resp.Secret.InternalData["expiration"])
+	require.Equal(t, formatTime(key.Expires), resp.Data["expiration_time"])
+
+	secret := resp.Secret
+	secret.IssueTime = time.Now()
+
+	renew := func(t *testing.T) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+	}
+
+	t.Run("Renew within max_ttl", func(t *testing.T) {
+		resp, err := renew(t)
+		require.NoError(t, err)
+		require.Equal(t, 4*time.Hour, resp.Secret.MaxTTL)
+	})
+
+	t.Run("Renew capped to key expiration", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"max_ttl": "48h",
+		})
+		require.NoError(t, err)
+
+		resp, err := renew(t)
+		require.NoError(t, err)
+		require.InDelta(t, (4*time.Hour + 30*time.Minute).Seconds(), resp.Secret.MaxTTL.Seconds(), 60)
+	})
+
+	t.Run("Renew after key expired", func(t *testing.T) {
+		secret.InternalData["expiration"] = formatTime(time.Now().Add(-time.Minute))
+
+		_, err := renew(t)
+		require.Error(t, err)
+	})
+
+	t.Run("Keys without expiration", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"key_expiration": false,
+		})
+		require.NoError(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotContains(t, resp.Secret.InternalData, "expiration")
+		require.True(t, fake.key(resp.Data["application_key_id"].(string)).Expires.IsZero())
+	})
+}
+
+func TestCredentialsMultipleBuckets(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	dataID := fake.addBucket("data")
+	logsID := fake.addBucket("logs")
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": []string{"listFiles", "readFiles"},
+		"bucket_names": "data,logs",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + testRoleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+
+	key := fake.key(resp.Data["application_key_id"].(string))
+	require.Equal(t, []string{dataID, logsID}, key.BucketIDs)
+	require.Equal(t, []string{"data", "logs"}, resp.Data["bucket_names"])
+	require.Equal(t, []string{dataID, logsID}, resp.Data["bucket_ids"])
+	require.Empty(t, resp.Data["bucket_name"])
+	require.Empty(t, resp.Data["bucket_id"])
+
+	t.Run("Unknown bucket", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"bucket_names": "data,missing",
+		})
+		require.NoError(t, err)
+
+		keys := len(fake.keys)
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.ErrorContains(t, err, `bucket "missing" not found`)
+		require.Len(t, fake.keys, keys)
+	})
+}
+
+func TestCredentialsBucketID(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	dataID := fake.addBucket("data")
+	logsID := fake.addBucket("logs")
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": []string{"readFiles"},
+		"bucket_id":    dataID,
+		"name_prefix":  "reports/",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testTokenRoleRead(t, b, s, testRoleName)
+	require.NoError(t, err)
+	require.Equal(t, dataID, resp.Data["bucket_id"])
+	require.Equal(t, []string{dataID}, resp.Data["bucket_ids"])
+
+	readCreds := func(t *testing.T) (*logical.Response, *fakeB2Key) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp.Secret)
+
+		return resp, fake.key(resp.Data["application_key_id"].(string))
+	}
+
+	resp, key := readCreds(t)
+	require.Equal(t, []string{dataID}, key.BucketIDs)
+	require.Equal(t, "reports/", key.NamePrefix)
+	require.Zero(t, fake.bucketLookups)
+
+	// The bucket's name was never looked up
+	require.Equal(t, dataID, resp.Data["bucket_id"])
+	require.Equal(t, "", resp.Data["bucket_name"])
+	require.Equal(t, []string{""}, resp.Data["bucket_names"])
+
+	// Names and IDs can be combined
+	_, err = testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+		"bucket_names": "logs,data",
+	})
+	require.NoError(t, err)
+
+	resp, key = readCreds(t)
+	require.Equal(t, []string{dataID, logsID}, key.BucketIDs)
+	require.Equal(t, []string{dataID, logsID}, resp.Data["bucket_ids"])
+	require.Equal(t, []string{"data", "logs"}, resp.Data["bucket_names"])
+
+	resp, err = testTokenRoleCreate(t, b, s, "both", map[string]interface{}{
+		"capabilities": []string{"readFiles"},
+		"bucket_id":    dataID,
+		"bucket_ids":   logsID,
+	})
+	require.NoError(t, err)
+	require.True(t, resp.IsError())
+}
+
+func TestCredentialsIdentityTemplates(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	fake.addBucket("shared")
+
+	system := b.System().(*logical.StaticSystemView)
+	system.EntityVal = &logical.Entity{
+		ID:       "entity-id",
+		Name:     "alice",
+		Metadata: map[string]string{"team": "data.eng"},
+	}
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities":    []string{"listFiles", "readFiles", "writeFiles"},
+		"bucket_name":     "shared",
+		"key_name_prefix": "vault-{{identity.entity.metadata.team}}-",
+		"name_prefix":     "users/{{identity.entity.name}}/",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	readCreds := func(entityID string) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+			EntityID:  entityID,
+		})
+	}
+
+	resp, err = readCreds("entity-id")
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+
+	key := fake.key(resp.Data["application_key_id"].(string))
+	require.Equal(t, "users/alice/", key.NamePrefix)
+	require.True(t, strings.HasPrefix(key.Name, "vault-data-eng-"))
+
+	// The role keeps its templates
+	resp, err = testTokenRoleRead(t, b, s, testRoleName)
+	require.NoError(t, err)
+	require.Equal(t, "users/{{identity.entity.name}}/", resp.Data["name_prefix"])
+
+	t.Run("No entity", func(t *testing.T) {
+		keys := len(fake.keys)
+
+		resp, err := readCreds("")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Len(t, fake.keys, keys)
+	})
+
+	t.Run("Unsafe value", func(t *testing.T) {
+		system.EntityVal.Name = "alice/../bob"
+		defer func() { system.EntityVal.Name = "alice" }()
+		keys := len(fake.keys)
+
+		resp, err := readCreds("entity-id")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), "name_prefix")
+		require.Len(t, fake.keys, keys)
+	})
+
+	t.Run("Missing metadata", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"name_prefix": "{{identity.entity.metadata.department}}/",
+		})
+		require.NoError(t, err)
+
+		resp, err := readCreds("entity-id")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Invalid template", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "invalid", map[string]interface{}{
+			"capabilities": []string{"readFiles"},
+			"bucket_name":  "shared",
+			"name_prefix":  "users/{{identity.entity.name/",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = testTokenRoleCreate(t, b, s, "invalid", map[string]interface{}{
+			"capabilities":    []string{"readFiles"},
+			"key_name_prefix": "vault-{{time.now}}-",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+func TestCredentialsNarrowing(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	fake.addBucket("data")
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": []string{"listFiles", "readFiles", "writeFiles"},
+		"bucket_name":  "data",
+		"name_prefix":  "reports/",
+		"ttl":          "1h",
+		"max_ttl":      "4h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	writeCreds := func(d map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+			Data:      d,
+		})
+	}
+
+	resp, err = writeCreds(map[string]interface{}{
+		"capabilities": "listFiles,readFiles",
+		"name_prefix":  "reports/2024/",
+		"ttl":          "30m",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+	require.Equal(t, 30*time.Minute, resp.Secret.TTL)
+	require.Equal(t, 4*time.Hour, resp.Secret.MaxTTL)
+
+	key := fake.key(resp.Data["application_key_id"].(string))
+	require.Equal(t, []string{"listFiles", "readFiles"}, key.Capabilities)
+	require.Equal(t, "reports/2024/", key.NamePrefix)
+
+	t.Run("Renew keeps the requested TTL", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    resp.Secret,
+		})
+		require.NoError(t, err)
+		require.Equal(t, 30*time.Minute, resp.Secret.TTL)
+	})
+
+	t.Run("Nothing requested", func(t *testing.T) {
+		resp, err := writeCreds(nil)
+		require.NoError(t, err)
+		require.NotNil(t, resp.Secret)
+		require.Equal(t, time.Hour, resp.Secret.TTL)
+
+		key := fake.key(resp.Data["application_key_id"].(string))
+		require.Equal(t, []string{"listFiles", "readFiles", "writeFiles"}, key.Capabilities)
+		require.Equal(t, "reports/", key.NamePrefix)
+	})
+
+	t.Run("Outside the role", func(t *testing.T) {
+		keys := len(fake.keys)
+
+		for _, d := range []map[string]interface{}{
+			{"capabilities": "readFiles,deleteFiles"},
+			{"capabilities": ""},
+			{"name_prefix": "logs/"},
+			{"name_prefix": "reports"},
+			{"name_prefix": "reports/../logs/"},
+			{"name_prefix": "reports//"},
+			{"name_prefix": "reports/a\\b/"},
+			{"name_prefix": "reports/2024\n/"},
+			{"ttl": "5h"},
+			{"ttl": "-1"},
+		} {
+			resp, err := writeCreds(d)
+			require.NoError(t, err)
+			require.True(t, resp.IsError(), d)
+		}
+
+		require.Len(t, fake.keys, keys)
+	})
+
+	t.Run("name_prefix without a bucket", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "unrestricted", map[string]interface{}{
+			"capabilities": []string{"readFiles"},
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/unrestricted",
+			Storage:   s,
+			Data:      map[string]interface{}{"name_prefix": "reports/"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		// An empty name_prefix asks for nothing narrower
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/unrestricted",
+			Storage:   s,
+			Data:      map[string]interface{}{"name_prefix": ""},
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, "", resp.Data["name_prefix"])
+	})
+}
+
+func TestCredentialsS3(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": []string{"listBuckets", "readFiles"},
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	readCreds := func(t *testing.T) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotNil(t, resp.Secret)
+
+		return resp
+	}
+
+	resp = readCreds(t)
+	require.Equal(t, "https://api.fake.backblazeb2.com", resp.Data["api_url"])
+	require.Equal(t, "https://f000.fake.backblazeb2.com", resp.Data["download_url"])
+	require.Equal(t, "https://s3.us-west-004.backblazeb2.com", resp.Data["s3_endpoint"])
+	require.Equal(t, "us-west-004", resp.Data["region"])
+	require.NotContains(t, resp.Data, "aws_access_key_id")
+	require.NotContains(t, resp.Data, "aws_secret_access_key")
+
+	t.Run("AWS aliases", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"aws_credential_aliases": true,
+		})
+		require.NoError(t, err)
+
+		resp := readCreds(t)
+		require.Equal(t, resp.Data["application_key_id"], resp.Data["aws_access_key_id"])
+		require.Equal(t, resp.Data["application_key"], resp.Data["aws_secret_access_key"])
+	})
+
+	t.Run("Account unavailable", func(t *testing.T) {
+		b.resetConnection(defaultConnectionName)
+		fake.accountErr = errors.New("simulated B2 failure")
+		defer func() { fake.accountErr = nil }()
+		keys := len(fake.keys)
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.Error(t, err)
+		require.Len(t, fake.keys, keys)
+	})
+}
+
+func TestCredentialsCapabilitySet(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testCapabilitySetWrite(b, s, "readers", map[string]interface{}{
+		"capabilities": "listFiles,readFiles",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capability_set": "readers",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Keys get the set's capabilities as of when they are issued
+	resp, err = testCapabilitySetWrite(b, s, "readers", map[string]interface{}{
+		"capabilities": "listFiles",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + testRoleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"listFiles"}, resp.Data["capabilities"])
+	require.Equal(t, []string{"listFiles"}, fake.key(resp.Data["application_key_id"].(string)).Capabilities)
+}
+
+func TestCredentialsFormat(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	fake.addBucket("data")
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": []string{"listFiles", "readFiles", "writeFiles"},
+		"bucket_name":  "data",
+		"name_prefix":  "restic/",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + testRoleName,
+		Storage:   s,
+		Data:      map[string]interface{}{"format": "restic-env"},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+
+	config := resp.Data["config"].(string)
+	require.Contains(t, config, "export B2_ACCOUNT_ID="+resp.Data["application_key_id"].(string)+"\n")
+	require.Contains(t, config, "export RESTIC_REPOSITORY=b2:data:restic\n")
+
+	t.Run("No format", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.NotContains(t, resp.Data, "config")
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		keys := len(fake.keys)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + testRoleName,
+			Storage:   s,
+			Data:      map[string]interface{}{"format": "s3cmd"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Len(t, fake.keys, keys)
+	})
+}
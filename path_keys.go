@@ -0,0 +1,155 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// List the issued keys
+func (b *backblazeB2Backend) pathKeys() *framework.Path {
+	return &framework.Path{
+		Pattern:      "keys/?",
+		HelpSynopsis: "List application keys issued for roles.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathKeysList,
+			},
+		},
+	}
+}
+
+// Define the RD functions for the issued keys path
+func (b *backblazeB2Backend) pathKeysRead() *framework.Path {
+	return &framework.Path{
+		Pattern:      "keys/" + framework.GenericNameRegex("application_key_id"),
+		HelpSynopsis: "Read who an application key was issued to, or forget a key.",
+		HelpDescription: "Use this endpoint to find the role, requester and lease of an application key issued for a role. " +
+			"Deleting the record leaves the key and its lease alone, but lets tidy delete the key once its lease is gone.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"application_key_id": {
+				Type:        framework.TypeString,
+				Description: "Application key ID",
+				Required:    true,
+			},
+		},
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathKeyInfoRead,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathKeyInfoDelete,
+			},
+		},
+	}
+}
+
+func (b *backblazeB2Backend) pathKeysList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	keys, err := req.Storage.List(ctx, issuedKeyStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of issued keys: %w", err)
+	}
+
+	return logical.ListResponse(keys), nil
+}
+
+func (b *backblazeB2Backend) pathKeyInfoRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	applicationKeyId := d.Get("application_key_id").(string)
+
+	key, err := b.getIssuedKey(ctx, req.Storage, applicationKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"application_key_id": applicationKeyId,
+			"role":               key.Role,
+			"connection":         key.Connection,
+			"key_name":           key.KeyName,
+			"create_time":        formatTime(key.CreateTime),
+			"entity_id":          key.EntityID,
+			"display_name":       key.DisplayName,
+			"lease_id":           key.LeaseID,
+			"expire_time":        formatTime(key.ExpireTime),
+		},
+	}, nil
+}
+
+func (b *backblazeB2Backend) pathKeyInfoDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	applicationKeyId := d.Get("application_key_id").(string)
+
+	if err := req.Storage.Delete(ctx, issuedKeyStoragePrefix+applicationKeyId); err != nil {
+		return nil, fmt.Errorf("error deleting issued key record: %w", err)
+	}
+
+	return nil, nil
+}
+
+// updateIssuedKeyOnRenew adds the lease ID to a key's record, which
+// renewals are the first to know, and when the lease can expire by now,
+// unless expireTime is zero. Keys issued before this mount kept records
+// get one.
+func (b *backblazeB2Backend) updateIssuedKeyOnRenew(ctx context.Context, req *logical.Request, role string, expireTime time.Time) error {
+	applicationKeyId, ok := req.Secret.InternalData["application_key_id"].(string)
+	if !ok {
+		return fmt.Errorf("secret is missing internal application_key_id")
+	}
+
+	key, err := b.getIssuedKey(ctx, req.Storage, applicationKeyId)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case key == nil:
+		connection, _ := req.Secret.InternalData["connection"].(string)
+		key = &issuedKey{
+			Role:       role,
+			Connection: connection,
+			CreateTime: req.Secret.IssueTime,
+		}
+	case key.LeaseID == "" && req.Secret.LeaseID != "":
+	case !expireTime.IsZero() && !key.ExpireTime.Equal(expireTime):
+	default:
+		return nil
+	}
+
+	if req.Secret.LeaseID != "" {
+		key.LeaseID = req.Secret.LeaseID
+	}
+	if !expireTime.IsZero() {
+		key.ExpireTime = expireTime
+	}
+
+	return b.saveIssuedKey(ctx, req.Storage, applicationKeyId, key)
+}
+
+// getIssuedKey returns the record of an issued key, nil if there is none
+func (b *backblazeB2Backend) getIssuedKey(ctx context.Context, s logical.Storage, applicationKeyId string) (*issuedKey, error) {
+	entry, err := s.Get(ctx, issuedKeyStoragePrefix+applicationKeyId)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving issued key record: %w", err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var key issuedKey
+	if err := entry.DecodeJSON(&key); err != nil {
+		return nil, fmt.Errorf("error decoding issued key record: %w", err)
+	}
+
+	return &key, nil
+}
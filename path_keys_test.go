@@ -0,0 +1,130 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	ctx := context.Background()
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": testApplicationKeyCapabilities,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation:   logical.ReadOperation,
+		Path:        "creds/" + testRoleName,
+		Storage:     s,
+		EntityID:    "entity-id",
+		DisplayName: "token-alice",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, resp.Secret)
+
+	secret := resp.Secret
+	id := resp.Data["application_key_id"].(string)
+
+	readKey := func(t *testing.T, id string) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "keys/" + id,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("List", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "keys/",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{id}, resp.Data["keys"])
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		resp := readKey(t, id)
+		require.Equal(t, id, resp.Data["application_key_id"])
+		require.Equal(t, testRoleName, resp.Data["role"])
+		require.Equal(t, "", resp.Data["connection"])
+		require.Equal(t, fake.key(id).Name, resp.Data["key_name"])
+		require.Equal(t, "entity-id", resp.Data["entity_id"])
+		require.Equal(t, "token-alice", resp.Data["display_name"])
+		require.Empty(t, resp.Data["lease_id"])
+
+		createTime, err := time.Parse(time.RFC3339, resp.Data["create_time"].(string))
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), createTime, time.Minute)
+
+		// The role has no max_ttl, so the mount's holds
+		expireTime, err := time.Parse(time.RFC3339, resp.Data["expire_time"].(string))
+		require.NoError(t, err)
+		require.WithinDuration(t, createTime.Add(b.System().MaxLeaseTTL()), expireTime, time.Minute)
+
+		require.Nil(t, readKey(t, "missing"))
+	})
+
+	t.Run("Renew records the lease", func(t *testing.T) {
+		secret.LeaseID = "backblazeb2/creds/" + testRoleName + "/lease"
+		secret.IssueTime = time.Now()
+
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"max_ttl": "1h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		_, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RenewOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+
+		resp = readKey(t, id)
+		require.Equal(t, secret.LeaseID, resp.Data["lease_id"])
+		require.Equal(t, "token-alice", resp.Data["display_name"])
+		require.Equal(t, formatTime(secret.IssueTime.Add(time.Hour)), resp.Data["expire_time"])
+	})
+
+	t.Run("Revoke removes the record", func(t *testing.T) {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+		require.Nil(t, readKey(t, id))
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(t, b.saveIssuedKey(ctx, s, "lost-lease", &issuedKey{Role: testRoleName}))
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "keys/lost-lease",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Nil(t, readKey(t, "lost-lease"))
+	})
+}
+
+func TestIssuedKeyExpired(t *testing.T) {
+	now := time.Now()
+
+	require.False(t, (&issuedKey{}).expired(now))
+	require.False(t, (&issuedKey{ExpireTime: now.Add(time.Minute)}).expired(now))
+	require.True(t, (&issuedKey{ExpireTime: now}).expired(now))
+}
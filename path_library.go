@@ -0,0 +1,636 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+const libraryStoragePrefix = "library/"
+
+// librarySet is a pool of pre-created application keys which are checked
+// out to callers and replaced when they are checked back in
+type librarySet struct {
+
+	// Capabilities is a list of strings which reflects
+	// the capabilities the keys will have in B2
+	Capabilities []string `json:"capabilities"`
+
+	// AllowUnknownCapabilities skips checking Capabilities against
+	// the catalog, for capabilities B2 adds after this plugin is built
+	AllowUnknownCapabilities bool `json:"allow_unknown_capabilities"`
+
+	// KeyNamePrefix is what we prepend to the key names
+	KeyNamePrefix string `json:"key_name_prefix"`
+
+	// BucketName is an optional restriction to limit the keys to
+	// a particular bucket
+	BucketName string `json:"bucket_name"`
+
+	// NamePrefix is an optional restriction to limit which object
+	// name prefixes the keys can operate on
+	NamePrefix string `json:"name_prefix"`
+
+	// Connection is the name of the connection keys are created
+	// with, empty for the mount's default config
+	Connection string `json:"connection"`
+
+	// PoolSize is how many keys the set holds
+	PoolSize int `json:"pool_size"`
+
+	// TTL and MaxTTL limit how long a key may be checked out for
+	TTL    time.Duration `json:"ttl"`
+	MaxTTL time.Duration `json:"max_ttl"`
+
+	// DisableCheckInEnforcement allows anyone with access to the
+	// check-in path to check in any key, not just their own
+	DisableCheckInEnforcement bool `json:"disable_check_in_enforcement"`
+
+	Keys []*libraryKey `json:"keys"`
+}
+
+// libraryKey is one of the keys in a library set
+type libraryKey struct {
+	ApplicationKeyId string `json:"application_key_id"`
+	ApplicationKey   string `json:"application_key"`
+
+	// Connection is the connection the key was created with, which
+	// may differ from the set's if it has been changed since
+	Connection string `json:"connection"`
+
+	// CheckOut is nil while the key is available
+	CheckOut *libraryCheckOut `json:"check_out,omitempty"`
+}
+
+// libraryCheckOut records who has a key checked out
+type libraryCheckOut struct {
+	// ID ties the check-out to its lease, so revoking a stale lease
+	// can't check in the key from under a later borrower
+	ID string `json:"id"`
+
+	BorrowerEntityID    string    `json:"borrower_entity_id"`
+	BorrowerClientToken string    `json:"borrower_client_token"`
+	Time                time.Time `json:"time"`
+}
+
+// keyRole describes the set's keys in the form expected by
+// b2ApplicationKeyCreate
+func (l *librarySet) keyRole() backblazeB2RoleEntry {
+	return backblazeB2RoleEntry{
+		Capabilities:  l.Capabilities,
+		KeyNamePrefix: l.KeyNamePrefix,
+		BucketNames:   normalizeBucketList([]string{l.BucketName}),
+		NamePrefix:    l.NamePrefix,
+		Connection:    l.Connection,
+	}
+}
+
+// key returns the set's key with the given ID, or nil
+func (l *librarySet) key(applicationKeyId string) *libraryKey {
+	for _, key := range l.Keys {
+		if key.ApplicationKeyId == applicationKeyId {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// keyChanged reports whether an updated set needs different keys
+func (l *librarySet) keyChanged(updated *librarySet) bool {
+	return l.KeyNamePrefix != updated.KeyNamePrefix ||
+		l.BucketName != updated.BucketName ||
+		l.NamePrefix != updated.NamePrefix ||
+		l.Connection != updated.Connection ||
+		strings.Join(l.Capabilities, ",") != strings.Join(updated.Capabilities, ",")
+}
+
+// List the defined library sets
+func (b *backblazeB2Backend) pathLibrary() *framework.Path {
+	return &framework.Path{
+		Pattern:      "library/?",
+		HelpSynopsis: "List configured library sets.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathLibraryList,
+			},
+		},
+	}
+}
+
+// pathLibraryList lists the currently defined library sets
+func (b *backblazeB2Backend) pathLibraryList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	sets, err := req.Storage.List(ctx, libraryStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of library sets: %w", err)
+	}
+
+	return logical.ListResponse(sets), nil
+}
+
+// Define the CRUD functions for the library path
+func (b *backblazeB2Backend) pathLibraryCRUD() *framework.Path {
+	return &framework.Path{
+		Pattern:         "library/" + framework.GenericNameRegex("name"),
+		HelpSynopsis:    "Configure a library set of Backblaze B2 application keys.",
+		HelpDescription: "Use this endpoint to manage a pool of pre-created application keys which are checked out to callers and replaced when checked back in.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Library set name",
+				Required:    true,
+			},
+			"capabilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Comma-separated list of capabilities",
+				Required:    true,
+			},
+			"allow_unknown_capabilities": {
+				Type:        framework.TypeBool,
+				Description: "Accept capabilities this plugin doesn't know about, for capabilities added to B2 since it was built",
+			},
+			"key_name_prefix": {
+				Type:        framework.TypeString,
+				Description: "Prefix for key names created for this set",
+				Default:     "vault-library-",
+				Required:    false,
+			},
+			"bucket_name": {
+				Type:        framework.TypeString,
+				Description: "Optional bucket name on which to restrict the keys",
+				Required:    false,
+			},
+			"name_prefix": {
+				Type:        framework.TypeString,
+				Description: "Optional prefix to further restrict access to files whose names start with the prefix",
+				Required:    false,
+			},
+			"connection": {
+				Type:        framework.TypeString,
+				Description: "Optional name of the connection to create keys with. Defaults to the mount's config.",
+				Required:    false,
+			},
+			"pool_size": {
+				Type:        framework.TypeInt,
+				Description: "Number of keys in the set",
+				Default:     1,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Optional default TTL of a check-out",
+			},
+			"max_ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Optional maximum TTL of a check-out",
+			},
+			"disable_check_in_enforcement": {
+				Type:        framework.TypeBool,
+				Description: "Allow keys to be checked in by anyone, not just the entity or token which checked them out",
+				Default:     false,
+			},
+		},
+
+		ExistenceCheck: b.pathLibraryExistsCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathLibraryWrite,
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathLibraryRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathLibraryWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathLibraryDelete,
+			},
+		},
+	}
+}
+
+// Define the status path for library sets
+func (b *backblazeB2Backend) pathLibraryStatus() *framework.Path {
+	return &framework.Path{
+		Pattern:      "library/" + framework.GenericNameRegex("name") + "/status",
+		HelpSynopsis: "Check the status of the keys in a library set.",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Library set name",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathLibraryStatusRead,
+			},
+		},
+	}
+}
+
+// pathLibraryExistsCheck checks to see if a library set exists
+func (b *backblazeB2Backend) pathLibraryExistsCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	set, err := b.getLibrarySet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+
+	return set != nil, nil
+}
+
+// pathLibraryRead reads information on a current library set
+func (b *backblazeB2Backend) pathLibraryRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	set, err := b.getLibrarySet(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return nil, nil
+	}
+
+	ids := make([]string, 0, len(set.Keys))
+	for _, key := range set.Keys {
+		ids = append(ids, key.ApplicationKeyId)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"capabilities":                 set.Capabilities,
+			"allow_unknown_capabilities":   set.AllowUnknownCapabilities,
+			"key_name_prefix":              set.KeyNamePrefix,
+			"bucket_name":                  set.BucketName,
+			"name_prefix":                  set.NamePrefix,
+			"connection":                   set.Connection,
+			"pool_size":                    set.PoolSize,
+			"ttl":                          set.TTL.Seconds(),
+			"max_ttl":                      set.MaxTTL.Seconds(),
+			"disable_check_in_enforcement": set.DisableCheckInEnforcement,
+			"application_key_ids":          ids,
+		},
+	}, nil
+}
+
+// pathLibraryStatusRead reports which keys in a set are checked out
+func (b *backblazeB2Backend) pathLibraryStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.librarySetLocks, name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	set, err := b.getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return logical.ErrorResponse("unknown library set %q", name), nil
+	}
+
+	status := make(map[string]interface{}, len(set.Keys))
+	for _, key := range set.Keys {
+		keyStatus := map[string]interface{}{
+			"available": key.CheckOut == nil,
+		}
+
+		if key.CheckOut != nil {
+			keyStatus["borrower_entity_id"] = key.CheckOut.BorrowerEntityID
+			keyStatus["checked_out_time"] = formatTime(key.CheckOut.Time)
+		}
+
+		status[key.ApplicationKeyId] = keyStatus
+	}
+
+	return &logical.Response{
+		Data: status,
+	}, nil
+}
+
+// pathLibraryWrite creates/updates a library set. New keys are created to
+// fill the pool, and if the key settings change every available key is
+// replaced straight away. Checked out keys are replaced on check-in.
+func (b *backblazeB2Backend) pathLibraryWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.librarySetLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := b.getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	setExists := true
+	if set == nil {
+		setExists = false
+		set = &librarySet{}
+	}
+	previous := *set
+
+	for _, key := range []string{"key_name_prefix", "bucket_name", "name_prefix", "connection"} {
+		v, ok := d.GetOk(key)
+
+		if !ok && setExists {
+			continue
+		}
+
+		nv := ""
+
+		if ok {
+			nv = strings.TrimSpace(v.(string))
+		} else if !setExists {
+			v := d.GetDefaultOrZero(key)
+			nv = strings.TrimSpace(v.(string))
+		}
+
+		switch key {
+		case "key_name_prefix":
+			set.KeyNamePrefix = nv
+		case "bucket_name":
+			set.BucketName = nv
+		case "name_prefix":
+			set.NamePrefix = nv
+		case "connection":
+			set.Connection = nv
+		}
+	}
+
+	if c, ok := d.GetOk("capabilities"); ok {
+		set.Capabilities = c.([]string)
+	}
+
+	if len(set.Capabilities) <= 0 {
+		return logical.ErrorResponse("capabilities must be set"), nil
+	}
+
+	if v, ok := d.GetOk("allow_unknown_capabilities"); ok {
+		set.AllowUnknownCapabilities = v.(bool)
+	}
+
+	if !set.AllowUnknownCapabilities {
+		if err := validateCapabilities(set.Capabilities); err != nil {
+			return logical.ErrorResponse("%s; set allow_unknown_capabilities to use capabilities newer than this plugin", err), nil
+		}
+	}
+
+	if set.NamePrefix != "" && set.BucketName == "" {
+		return logical.ErrorResponse("bucket_name must be set if name_prefix is set"), nil
+	}
+
+	if set.Connection != defaultConnectionName {
+		c, err := b.getConnection(ctx, req.Storage, set.Connection)
+		if err != nil {
+			return nil, err
+		}
+
+		if c == nil {
+			return logical.ErrorResponse("connection %q does not exist", set.Connection), nil
+		}
+	}
+
+	if poolSizeRaw, ok := d.GetOk("pool_size"); ok || !setExists {
+		if !ok {
+			poolSizeRaw = d.Get("pool_size")
+		}
+		set.PoolSize = poolSizeRaw.(int)
+	}
+
+	if set.PoolSize < 1 {
+		return logical.ErrorResponse("pool_size must be at least 1"), nil
+	}
+
+	checkedOut := 0
+	for _, key := range set.Keys {
+		if key.CheckOut != nil {
+			checkedOut++
+		}
+	}
+
+	if set.PoolSize < checkedOut {
+		return logical.ErrorResponse("pool_size cannot be less than the %d keys currently checked out", checkedOut), nil
+	}
+
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		set.TTL = time.Duration(ttlRaw.(int)) * time.Second
+	}
+
+	if maxTTLRaw, ok := d.GetOk("max_ttl"); ok {
+		set.MaxTTL = time.Duration(maxTTLRaw.(int)) * time.Second
+	}
+
+	if set.MaxTTL != 0 && set.TTL > set.MaxTTL {
+		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
+	}
+
+	if v, ok := d.GetOk("disable_check_in_enforcement"); ok {
+		set.DisableCheckInEnforcement = v.(bool)
+	}
+
+	if err := b.saveLibrarySet(ctx, req.Storage, name, set); err != nil {
+		return nil, err
+	}
+
+	// Shrink the pool, removing available keys
+	for i := len(set.Keys) - 1; i >= 0 && len(set.Keys) > set.PoolSize; i-- {
+		if key := set.Keys[i]; key.CheckOut == nil {
+			if err := b.replaceLibraryKey(ctx, req.Storage, name, set, key, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Replace available keys which no longer match the settings
+	if setExists && previous.keyChanged(set) {
+		for _, key := range slices.Clone(set.Keys) {
+			if key.CheckOut == nil {
+				if err := b.replaceLibraryKey(ctx, req.Storage, name, set, key, true); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	// Fill the pool
+	for len(set.Keys) < set.PoolSize {
+		if err := b.replaceLibraryKey(ctx, req.Storage, name, set, nil, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// pathLibraryDelete deletes a library set and its keys, as long as none
+// are checked out
+func (b *backblazeB2Backend) pathLibraryDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.librarySetLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := b.getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return nil, nil
+	}
+
+	for _, key := range set.Keys {
+		if key.CheckOut != nil {
+			return logical.ErrorResponse("key %q is checked out, check it in before deleting the library set", key.ApplicationKeyId), nil
+		}
+	}
+
+	// Remove keys one at a time, so a failure leaves the set
+	// describing what's left in B2
+	for _, key := range slices.Clone(set.Keys) {
+		if err := b.replaceLibraryKey(ctx, req.Storage, name, set, key, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, libraryStoragePrefix+name); err != nil {
+		return nil, fmt.Errorf("failed to delete library set from storage: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *backblazeB2Backend) getLibrarySet(ctx context.Context, s logical.Storage, name string) (*librarySet, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing library set name")
+	}
+
+	entry, err := s.Get(ctx, libraryStoragePrefix+name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve library set %q: %w", name, err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var set librarySet
+	if err := entry.DecodeJSON(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode library set %q: %w", name, err)
+	}
+
+	return &set, nil
+}
+
+func (b *backblazeB2Backend) saveLibrarySet(ctx context.Context, s logical.Storage, name string, set *librarySet) error {
+	entry, err := logical.StorageEntryJSON(libraryStoragePrefix+name, set)
+	if err != nil {
+		return fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to write entry to storage: %w", err)
+	}
+
+	return nil
+}
+
+// libraryKeyWALKind is the WAL entry kind written while a key is added to,
+// replaced in or removed from a library set
+const libraryKeyWALKind = "libraryKey"
+
+// libraryKeyWAL records an in-flight change to a library set's keys so
+// that it can be completed or undone if Vault stops part way through.
+// OldApplicationKeyId is empty when adding a key, and NewApplicationKeyId
+// is empty when removing one.
+type libraryKeyWAL struct {
+	Set string `json:"set" mapstructure:"set"`
+
+	keyReplacementWAL `mapstructure:",squash"`
+}
+
+// replaceLibraryKey swaps old, a key in the set, for a newly created one.
+// With a nil old the new key is added to the set, and without create old
+// is removed and nothing replaces it. The caller must hold the set's lock.
+func (b *backblazeB2Backend) replaceLibraryKey(ctx context.Context, s logical.Storage, name string, set *librarySet, old *libraryKey, create bool) error {
+	wal := &libraryKeyWAL{Set: name}
+
+	if old != nil {
+		wal.OldConnection = old.Connection
+		wal.OldApplicationKeyId = old.ApplicationKeyId
+	}
+
+	var createKey func() (*b2Key, error)
+	if create {
+		wal.NewConnection = set.Connection
+		wal.NewKeyName = set.KeyNamePrefix + uuid.New().String()
+
+		createKey = func() (*b2Key, error) {
+			return b.b2ApplicationKeyCreate(ctx, s, wal.NewKeyName, set.keyRole())
+		}
+	}
+
+	store := func(newKey *b2Key) error {
+		keys := make([]*libraryKey, 0, len(set.Keys)+1)
+		for _, key := range set.Keys {
+			if key != old {
+				keys = append(keys, key)
+			}
+		}
+		if newKey != nil {
+			keys = append(keys, &libraryKey{
+				ApplicationKeyId: newKey.ID,
+				ApplicationKey:   newKey.Secret,
+				Connection:       set.Connection,
+			})
+		}
+
+		previousKeys := set.Keys
+		set.Keys = keys
+
+		if err := b.saveLibrarySet(ctx, s, name, set); err != nil {
+			set.Keys = previousKeys
+			return err
+		}
+
+		return nil
+	}
+
+	// Library key names are unique, so there are no other keys with the
+	// new key's name to tell it apart from
+	return b.replaceKey(ctx, s, libraryKeyWALKind, wal, true, createKey, store)
+}
+
+// libraryKeyRollback finishes or undoes an interrupted change to a library
+// set's keys
+func (b *backblazeB2Backend) libraryKeyRollback(ctx context.Context, req *logical.Request, data interface{}) error {
+	var entry libraryKeyWAL
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
+
+	lock := locksutil.LockForKey(b.librarySetLocks, entry.Set)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := b.getLibrarySet(ctx, req.Storage, entry.Set)
+	if err != nil {
+		return err
+	}
+
+	return b.rollbackKeyReplacement(ctx, req.Storage, b.Logger().With("set", entry.Set), &entry.keyReplacementWAL, func(id string) bool {
+		return set != nil && set.key(id) != nil
+	})
+}
@@ -0,0 +1,343 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const libraryKeyType = "b2_library_key"
+
+func (b *backblazeB2Backend) libraryKeys() *framework.Secret {
+	return &framework.Secret{
+		Type: libraryKeyType,
+		Fields: map[string]*framework.FieldSchema{
+			"application_key_id": {
+				Type:        framework.TypeString,
+				Description: "Application Key ID",
+			},
+			"application_key": {
+				Type:        framework.TypeString,
+				Description: "Application Key",
+			},
+		},
+		Revoke: b.libraryKeyRevoke,
+		Renew:  b.libraryKeyRenew,
+	}
+}
+
+// Define the check-out path for library sets
+func (b *backblazeB2Backend) pathLibraryCheckOut() *framework.Path {
+	return &framework.Path{
+		Pattern:      "library/" + framework.GenericNameRegex("name") + "/check-out",
+		HelpSynopsis: "Check out an application key from a library set.",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Library set name",
+				Required:    true,
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Optional TTL of the check-out, no longer than the set's ttl",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathLibraryCheckOutUpdate,
+			},
+		},
+	}
+}
+
+// Define the check-in path for library sets
+func (b *backblazeB2Backend) pathLibraryCheckIn() *framework.Path {
+	return &framework.Path{
+		Pattern:      "library/" + framework.GenericNameRegex("name") + "/check-in",
+		HelpSynopsis: "Check application keys back in to a library set.",
+		Fields:       libraryCheckInFields(),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathLibraryCheckInUpdate(false),
+			},
+		},
+	}
+}
+
+// Define the manage check-in path for library sets, which lets operators
+// check in keys regardless of who checked them out
+func (b *backblazeB2Backend) pathLibraryManageCheckIn() *framework.Path {
+	return &framework.Path{
+		Pattern:      "library/manage/" + framework.GenericNameRegex("name") + "/check-in",
+		HelpSynopsis: "Force application keys back in to a library set.",
+		Fields:       libraryCheckInFields(),
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathLibraryCheckInUpdate(true),
+			},
+		},
+	}
+}
+
+func libraryCheckInFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"name": {
+			Type:        framework.TypeString,
+			Description: "Library set name",
+			Required:    true,
+		},
+		"application_key_ids": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Comma-separated list of application key IDs to check in. May be omitted if the caller has only one key checked out.",
+		},
+	}
+}
+
+// pathLibraryCheckOutUpdate hands an available key to the caller
+func (b *backblazeB2Backend) pathLibraryCheckOutUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.librarySetLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	set, err := b.getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if set == nil {
+		return logical.ErrorResponse("unknown library set %q", name), nil
+	}
+
+	var key *libraryKey
+	for _, k := range set.Keys {
+		if k.CheckOut == nil {
+			key = k
+			break
+		}
+	}
+
+	if key == nil {
+		return logical.ErrorResponse("no keys available for check-out in library set %q", name), nil
+	}
+
+	ttl := set.TTL
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		requested := time.Duration(ttlRaw.(int)) * time.Second
+		if ttl == 0 || requested < ttl {
+			ttl = requested
+		}
+	}
+
+	key.CheckOut = &libraryCheckOut{
+		ID:                  uuid.New().String(),
+		BorrowerEntityID:    req.EntityID,
+		BorrowerClientToken: req.ClientToken,
+		Time:                time.Now(),
+	}
+
+	if err := b.saveLibrarySet(ctx, req.Storage, name, set); err != nil {
+		return nil, err
+	}
+
+	resp := b.Secret(libraryKeyType).Response(map[string]interface{}{
+		"application_key_id": key.ApplicationKeyId,
+		"application_key":    key.ApplicationKey,
+	}, map[string]interface{}{
+		"application_key_id": key.ApplicationKeyId,
+		"set":                name,
+		"check_out_id":       key.CheckOut.ID,
+	})
+
+	if ttl > 0 {
+		resp.Secret.TTL = ttl
+	}
+
+	if set.MaxTTL > 0 {
+		resp.Secret.MaxTTL = set.MaxTTL
+	}
+
+	return resp, nil
+}
+
+// pathLibraryCheckInUpdate returns the check-in handler, which replaces
+// the checked in keys and makes them available again
+func (b *backblazeB2Backend) pathLibraryCheckInUpdate(manage bool) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		name := d.Get("name").(string)
+
+		lock := locksutil.LockForKey(b.librarySetLocks, name)
+		lock.Lock()
+		defer lock.Unlock()
+
+		set, err := b.getLibrarySet(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if set == nil {
+			return logical.ErrorResponse("unknown library set %q", name), nil
+		}
+
+		enforce := !manage && !set.DisableCheckInEnforcement
+
+		ids := d.Get("application_key_ids").([]string)
+		if len(ids) == 0 {
+			// Default to the caller's only checked out key
+			for _, key := range set.Keys {
+				if key.CheckOut != nil && (!enforce || isBorrower(req, key.CheckOut)) {
+					ids = append(ids, key.ApplicationKeyId)
+				}
+			}
+
+			if len(ids) != 1 {
+				return logical.ErrorResponse("application_key_ids must be set when %d keys are checked out", len(ids)), nil
+			}
+		}
+
+		var keys []*libraryKey
+		for _, id := range ids {
+			key := set.key(id)
+			if key == nil {
+				return logical.ErrorResponse("key %q is not in library set %q", id, name), nil
+			}
+
+			if enforce && key.CheckOut != nil && !isBorrower(req, key.CheckOut) {
+				return logical.ErrorResponse("key %q is checked out by someone else", id), nil
+			}
+
+			keys = append(keys, key)
+		}
+
+		var checkedIn []string
+		for _, key := range keys {
+			if key.CheckOut == nil {
+				continue
+			}
+
+			if err := b.libraryCheckIn(ctx, req.Storage, name, set, key); err != nil {
+				return nil, err
+			}
+			checkedIn = append(checkedIn, key.ApplicationKeyId)
+		}
+
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"check_ins": checkedIn,
+			},
+		}, nil
+	}
+}
+
+// isBorrower reports whether the request comes from whoever checked a key out
+func isBorrower(req *logical.Request, checkOut *libraryCheckOut) bool {
+	if checkOut.BorrowerEntityID != "" {
+		return req.EntityID == checkOut.BorrowerEntityID
+	}
+
+	return req.ClientToken == checkOut.BorrowerClientToken
+}
+
+// libraryCheckIn replaces a checked out key with a new, available one, so
+// the borrower can't keep using it. The caller must hold the set's lock.
+func (b *backblazeB2Backend) libraryCheckIn(ctx context.Context, s logical.Storage, name string, set *librarySet, key *libraryKey) error {
+	b.Logger().Info("Checking in library key", "set", name, "id", key.ApplicationKeyId)
+
+	// Keep the pool from growing past its size if it was shrunk while
+	// the key was checked out
+	return b.replaceLibraryKey(ctx, s, name, set, key, len(set.Keys) <= set.PoolSize)
+}
+
+// libraryKeyRevoke checks in a key when its lease ends
+func (b *backblazeB2Backend) libraryKeyRevoke(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	name, key, set, unlock, err := b.libraryLeaseKey(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Already checked in, or checked out again under a new lease
+	if key == nil {
+		return nil, nil
+	}
+
+	if err := b.libraryCheckIn(ctx, req.Storage, name, set, key); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// libraryKeyRenew extends a check-out, as long as the key hasn't been
+// checked in since
+func (b *backblazeB2Backend) libraryKeyRenew(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	_, key, set, unlock, err := b.libraryLeaseKey(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if key == nil {
+		return nil, errors.New("key has been checked in")
+	}
+
+	resp := &logical.Response{Secret: req.Secret}
+
+	if set.TTL > 0 {
+		resp.Secret.TTL = set.TTL
+	}
+	if set.MaxTTL > 0 {
+		resp.Secret.MaxTTL = set.MaxTTL
+	}
+
+	return resp, nil
+}
+
+// libraryLeaseKey locks the set a lease's key belongs to, and returns the
+// key if it's still checked out under the lease. The caller must call
+// unlock once done.
+func (b *backblazeB2Backend) libraryLeaseKey(ctx context.Context, req *logical.Request) (string, *libraryKey, *librarySet, func(), error) {
+	internal := make(map[string]string)
+	for _, field := range []string{"set", "application_key_id", "check_out_id"} {
+		raw, ok := req.Secret.InternalData[field]
+		if !ok {
+			return "", nil, nil, nil, fmt.Errorf("secret is missing internal %s", field)
+		}
+
+		value, ok := raw.(string)
+		if !ok {
+			return "", nil, nil, nil, fmt.Errorf("internal %s is not a string", field)
+		}
+
+		internal[field] = value
+	}
+
+	name := internal["set"]
+
+	lock := locksutil.LockForKey(b.librarySetLocks, name)
+	lock.Lock()
+
+	set, err := b.getLibrarySet(ctx, req.Storage, name)
+	if err != nil {
+		lock.Unlock()
+		return "", nil, nil, nil, err
+	}
+
+	if set == nil {
+		return name, nil, nil, lock.Unlock, nil
+	}
+
+	key := set.key(internal["application_key_id"])
+	if key == nil || key.CheckOut == nil || key.CheckOut.ID != internal["check_out_id"] {
+		return name, nil, set, lock.Unlock, nil
+	}
+
+	return name, key, set, lock.Unlock, nil
+}
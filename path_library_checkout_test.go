@@ -0,0 +1,231 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibraryCheckOut(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+		"capabilities": testApplicationKeyCapabilities,
+		"pool_size":    2,
+		"ttl":          "1h",
+		"max_ttl":      "2h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	var first *logical.Response
+
+	t.Run("Check out", func(t *testing.T) {
+		first, err = testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", map[string]interface{}{
+			"ttl": "30m",
+		})
+		require.NoError(t, err)
+		require.False(t, first.IsError())
+		require.NotNil(t, first.Secret)
+		require.Equal(t, libraryKeyType, first.Secret.InternalData["secret_type"])
+		require.Equal(t, 30*time.Minute, first.Secret.TTL)
+		require.Equal(t, 2*time.Hour, first.Secret.MaxTTL)
+
+		id := first.Data["application_key_id"].(string)
+		require.Equal(t, fake.key(id).Secret, first.Data["application_key"])
+
+		// A longer TTL than the set's is capped
+		resp, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-2", map[string]interface{}{
+			"ttl": "3h",
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+		require.Equal(t, time.Hour, resp.Secret.TTL)
+		require.NotEqual(t, id, resp.Data["application_key_id"])
+	})
+
+	t.Run("Check out - pool exhausted", func(t *testing.T) {
+		resp, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-3", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = testLibraryCheckOut(b, s, "missing", "entity-3", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Check in - enforcement", func(t *testing.T) {
+		id := first.Data["application_key_id"].(string)
+
+		resp, err := testLibraryCheckIn(b, s, testLibrarySetName, "entity-2", map[string]interface{}{
+			"application_key_ids": id,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = testLibraryCheckIn(b, s, testLibrarySetName, "entity-3", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		resp, err = testLibraryCheckIn(b, s, testLibrarySetName, "entity-1", map[string]interface{}{
+			"application_key_ids": "unknown",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.NotNil(t, fake.key(id))
+	})
+
+	t.Run("Check in - replaces key", func(t *testing.T) {
+		id := first.Data["application_key_id"].(string)
+
+		resp, err := testLibraryCheckIn(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.Equal(t, []string{id}, resp.Data["check_ins"])
+		require.Nil(t, fake.key(id))
+
+		ids := testLibraryKeyIDs(t, b, s)
+		require.Len(t, ids, 2)
+		require.NotContains(t, ids, id)
+
+		resp, err = testLibraryCheckOut(b, s, testLibrarySetName, "entity-3", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+	})
+
+	t.Run("Manage check in", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      libraryStoragePrefix + "manage/" + testLibrarySetName + "/check-in",
+			Data: map[string]interface{}{
+				"application_key_ids": testLibraryKeyIDs(t, b, s),
+			},
+			Storage: s,
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.Data["check_ins"], 2)
+
+		resp, err = testLibraryStatus(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		for _, status := range resp.Data {
+			require.Equal(t, true, status.(map[string]interface{})["available"])
+		}
+	})
+
+	t.Run("Check in - enforcement disabled", func(t *testing.T) {
+		resp, err := testLibraryUpdate(b, s, testLibrarySetName, map[string]interface{}{
+			"disable_check_in_enforcement": true,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		resp, err = testLibraryCheckIn(b, s, testLibrarySetName, "entity-2", nil)
+		require.NoError(t, err)
+		require.Len(t, resp.Data["check_ins"], 1)
+	})
+}
+
+func TestLibraryLease(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+		"capabilities": testApplicationKeyCapabilities,
+		"ttl":          "1h",
+		"max_ttl":      "2h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	t.Run("Renew", func(t *testing.T) {
+		resp, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+
+		renewed, err := testLibraryLease(b, s, logical.RenewOperation, resp.Secret)
+		require.NoError(t, err)
+		require.Equal(t, time.Hour, renewed.Secret.TTL)
+		require.Equal(t, 2*time.Hour, renewed.Secret.MaxTTL)
+	})
+
+	t.Run("Revoke checks in", func(t *testing.T) {
+		resp, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		set, err := b.getLibrarySet(context.Background(), s, testLibrarySetName)
+		require.NoError(t, err)
+		key := set.Keys[0]
+
+		secret := &logical.Secret{
+			InternalData: map[string]interface{}{
+				"secret_type":        libraryKeyType,
+				"application_key_id": key.ApplicationKeyId,
+				"set":                testLibrarySetName,
+				"check_out_id":       key.CheckOut.ID,
+			},
+		}
+
+		_, err = testLibraryLease(b, s, logical.RevokeOperation, secret)
+		require.NoError(t, err)
+		require.Nil(t, fake.key(key.ApplicationKeyId))
+
+		_, err = testLibraryLease(b, s, logical.RenewOperation, secret)
+		require.Error(t, err)
+	})
+
+	t.Run("Stale lease does not check in a new check-out", func(t *testing.T) {
+		stale, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+
+		resp, err := testLibraryCheckIn(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		current, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-2", nil)
+		require.NoError(t, err)
+		require.False(t, current.IsError())
+
+		_, err = testLibraryLease(b, s, logical.RevokeOperation, stale.Secret)
+		require.NoError(t, err)
+
+		id := current.Data["application_key_id"].(string)
+		require.NotNil(t, fake.key(id))
+
+		resp, err = testLibraryStatus(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.Equal(t, false, resp.Data[id].(map[string]interface{})["available"])
+	})
+}
+
+func testLibraryLease(b logical.Backend, s logical.Storage, op logical.Operation, secret *logical.Secret) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Secret:    secret,
+		Storage:   s,
+	})
+}
+
+func testLibraryCheckOut(b logical.Backend, s logical.Storage, name, entityID string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      libraryStoragePrefix + name + "/check-out",
+		Data:      d,
+		Storage:   s,
+		EntityID:  entityID,
+	})
+}
+
+func testLibraryCheckIn(b logical.Backend, s logical.Storage, name, entityID string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      libraryStoragePrefix + name + "/check-in",
+		Data:      d,
+		Storage:   s,
+		EntityID:  entityID,
+	})
+}
@@ -0,0 +1,434 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const testLibrarySetName = "test-library"
+
+func TestLibrarySet(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	fake.addBucket("backups")
+
+	t.Run("Create Library Set - invalid", func(t *testing.T) {
+		typeValues := map[string]map[string]interface{}{
+			"Missing capabilities": {
+				"pool_size": 2,
+			},
+			"Zero pool_size": {
+				"capabilities": testApplicationKeyCapabilities,
+				"pool_size":    0,
+			},
+			"Name prefix without bucket": {
+				"capabilities": testApplicationKeyCapabilities,
+				"name_prefix":  "logs/",
+			},
+			"Unknown connection": {
+				"capabilities": testApplicationKeyCapabilities,
+				"connection":   "missing",
+			},
+			"Unknown capability": {
+				"capabilities": []string{"listFiles", "readFile"},
+			},
+			"TTL greater than max_ttl": {
+				"capabilities": testApplicationKeyCapabilities,
+				"ttl":          "2h",
+				"max_ttl":      "1h",
+			},
+		}
+		for d, v := range typeValues {
+			t.Run(d, func(t *testing.T) {
+				resp, err := testLibraryWrite(b, s, testLibrarySetName, v)
+				require.NoError(t, err)
+				require.True(t, resp.IsError())
+			})
+		}
+
+		require.Len(t, fake.keys, 1)
+	})
+
+	t.Run("Create Library Set - pass", func(t *testing.T) {
+		resp, err := testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"bucket_name":  "backups",
+			"name_prefix":  "logs/",
+			"pool_size":    2,
+			"ttl":          "1h",
+			"max_ttl":      "4h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testLibraryRead(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.Equal(t, "vault-library-", resp.Data["key_name_prefix"])
+		require.Equal(t, 2, resp.Data["pool_size"])
+		require.Equal(t, float64(3600), resp.Data["ttl"])
+		require.Equal(t, float64(14400), resp.Data["max_ttl"])
+		require.Equal(t, false, resp.Data["disable_check_in_enforcement"])
+		require.NotContains(t, resp.Data, "application_key")
+
+		ids := resp.Data["application_key_ids"].([]string)
+		require.Len(t, ids, 2)
+		for _, id := range ids {
+			key := fake.key(id)
+			require.NotNil(t, key)
+			require.Contains(t, key.Name, "vault-library-")
+			require.Equal(t, testApplicationKeyCapabilities, key.Capabilities)
+			require.Equal(t, []string{"backups"}, key.BucketNames)
+			require.Equal(t, "logs/", key.NamePrefix)
+		}
+	})
+
+	t.Run("List Library Sets", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      libraryStoragePrefix,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{testLibrarySetName}, resp.Data["keys"])
+	})
+
+	t.Run("Grow and shrink pool", func(t *testing.T) {
+		ids := testLibraryKeyIDs(t, b, s)
+
+		resp, err := testLibraryUpdate(b, s, testLibrarySetName, map[string]interface{}{
+			"pool_size": 3,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		grown := testLibraryKeyIDs(t, b, s)
+		require.Len(t, grown, 3)
+		require.Subset(t, grown, ids)
+
+		resp, err = testLibraryUpdate(b, s, testLibrarySetName, map[string]interface{}{
+			"pool_size": 1,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		shrunk := testLibraryKeyIDs(t, b, s)
+		require.Len(t, shrunk, 1)
+		for _, id := range grown {
+			if id != shrunk[0] {
+				require.Nil(t, fake.key(id))
+			}
+		}
+		require.Len(t, fake.keys, 2)
+	})
+
+	t.Run("Changing key settings replaces available keys", func(t *testing.T) {
+		ids := testLibraryKeyIDs(t, b, s)
+
+		resp, err := testLibraryUpdate(b, s, testLibrarySetName, map[string]interface{}{
+			"capabilities": "listFiles",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		updated := testLibraryKeyIDs(t, b, s)
+		require.Len(t, updated, 1)
+		require.NotEqual(t, ids, updated)
+		require.Nil(t, fake.key(ids[0]))
+		require.Equal(t, []string{"listFiles"}, fake.key(updated[0]).Capabilities)
+
+		// Changing only the TTLs keeps the keys
+		resp, err = testLibraryUpdate(b, s, testLibrarySetName, map[string]interface{}{
+			"ttl": "30m",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Equal(t, updated, testLibraryKeyIDs(t, b, s))
+	})
+
+	t.Run("Cannot shrink below checked out keys", func(t *testing.T) {
+		resp, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		resp, err = testLibraryUpdate(b, s, testLibrarySetName, map[string]interface{}{
+			"pool_size": 0,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		resp, err := testLibraryStatus(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.Len(t, resp.Data, 1)
+
+		for _, status := range resp.Data {
+			status := status.(map[string]interface{})
+			require.Equal(t, false, status["available"])
+			require.Equal(t, "entity-1", status["borrower_entity_id"])
+			require.NotEmpty(t, status["checked_out_time"])
+		}
+
+		resp, err = testLibraryStatus(b, s, "missing")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Delete Library Set", func(t *testing.T) {
+		ids := testLibraryKeyIDs(t, b, s)
+
+		resp, err := testLibraryDelete(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.NotNil(t, fake.key(ids[0]))
+
+		resp, err = testLibraryCheckIn(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		ids = testLibraryKeyIDs(t, b, s)
+
+		resp, err = testLibraryDelete(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Nil(t, fake.key(ids[0]))
+		require.Len(t, fake.keys, 1)
+
+		resp, err = testLibraryRead(b, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Connection in use", func(t *testing.T) {
+		rootKey, err := fake.addKey("other-root", b2KeyOptions{Capabilities: append(rootKeyCapabilities, "listBuckets")})
+		require.NoError(t, err)
+
+		resp, err := testConnectionWrite(b, s, "other", map[string]interface{}{
+			"application_key_id": rootKey.ID,
+			"application_key":    rootKey.Secret,
+			"skip_verify":        true,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"connection":   "other",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testConnectionDelete(b, s, "other")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), testLibrarySetName)
+	})
+}
+
+func TestLibraryKeyWALRollback(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*backblazeB2Backend, logical.Storage, *fakeB2, *librarySet) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+
+		resp, err := testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+			"capabilities": "listFiles",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		set, err := b.getLibrarySet(ctx, s, testLibrarySetName)
+		require.NoError(t, err)
+
+		return b, s, fake, set
+	}
+
+	rollback := func(t *testing.T, b *backblazeB2Backend, s logical.Storage, wal *libraryKeyWAL) {
+		walID, err := framework.PutWAL(ctx, s, libraryKeyWALKind, wal)
+		require.NoError(t, err)
+
+		entry, err := framework.GetWAL(ctx, s, walID)
+		require.NoError(t, err)
+
+		err = b.walRollback(ctx, &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		require.NoError(t, err)
+	}
+
+	newKey := func(t *testing.T, fake *fakeB2) *b2Key {
+		key, err := fake.addKey("vault-library-test", b2KeyOptions{Capabilities: []string{"listFiles"}})
+		require.NoError(t, err)
+		return key
+	}
+
+	t.Run("Crash before set is written", func(t *testing.T) {
+		b, s, fake, set := setup(t)
+		halfCreated := newKey(t, fake)
+		current := set.Keys[0].ApplicationKeyId
+
+		rollback(t, b, s, &libraryKeyWAL{
+			Set: testLibrarySetName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: current,
+				NewApplicationKeyId: halfCreated.ID,
+			},
+		})
+
+		require.NotNil(t, fake.key(current))
+		require.Nil(t, fake.key(halfCreated.ID))
+	})
+
+	t.Run("Crash before key ID is recorded", func(t *testing.T) {
+		b, s, fake, set := setup(t)
+		halfCreated := newKey(t, fake)
+		current := set.Keys[0].ApplicationKeyId
+
+		rollback(t, b, s, &libraryKeyWAL{
+			Set: testLibrarySetName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: current,
+				NewKeyName:          halfCreated.Name,
+			},
+		})
+
+		require.NotNil(t, fake.key(current))
+		require.Nil(t, fake.key(halfCreated.ID))
+	})
+
+	t.Run("Crash before old key is deleted", func(t *testing.T) {
+		b, s, fake, set := setup(t)
+		old := newKey(t, fake)
+		current := set.Keys[0].ApplicationKeyId
+
+		rollback(t, b, s, &libraryKeyWAL{
+			Set: testLibrarySetName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: old.ID,
+				NewApplicationKeyId: current,
+			},
+		})
+
+		require.Nil(t, fake.key(old.ID))
+		require.NotNil(t, fake.key(current))
+	})
+
+	t.Run("Crash while filling the pool", func(t *testing.T) {
+		b, s, fake, _ := setup(t)
+		halfCreated := newKey(t, fake)
+
+		rollback(t, b, s, &libraryKeyWAL{
+			Set: testLibrarySetName,
+			keyReplacementWAL: keyReplacementWAL{
+				NewApplicationKeyId: halfCreated.ID,
+			},
+		})
+
+		require.Nil(t, fake.key(halfCreated.ID))
+	})
+
+	t.Run("Old key delete fails during check-in", func(t *testing.T) {
+		b, s, fake, set := setup(t)
+		old := set.Keys[0].ApplicationKeyId
+
+		resp, err := testLibraryCheckOut(b, s, testLibrarySetName, "entity-1", nil)
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		fake.deleteErr = errors.New("simulated B2 failure")
+		_, err = testLibraryCheckIn(b, s, testLibrarySetName, "entity-1", nil)
+		require.Error(t, err)
+		require.NotNil(t, fake.key(old))
+
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, ids, 1)
+
+		fake.deleteErr = nil
+		entry, err := framework.GetWAL(ctx, s, ids[0])
+		require.NoError(t, err)
+
+		err = b.walRollback(ctx, &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		require.NoError(t, err)
+		require.Nil(t, fake.key(old))
+
+		set, err = b.getLibrarySet(ctx, s, testLibrarySetName)
+		require.NoError(t, err)
+		require.Len(t, set.Keys, 1)
+		require.Nil(t, set.Keys[0].CheckOut)
+		require.NotNil(t, fake.key(set.Keys[0].ApplicationKeyId))
+	})
+}
+
+func testLibraryKeyIDs(t *testing.T, b logical.Backend, s logical.Storage) []string {
+	t.Helper()
+
+	resp, err := testLibraryRead(b, s, testLibrarySetName)
+	require.NoError(t, err)
+	require.NotNil(t, resp)
+
+	return resp.Data["application_key_ids"].([]string)
+}
+
+func TestLibrarySetUnknownCapabilities(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+		"capabilities":               []string{"listFiles", "futureCapability"},
+		"allow_unknown_capabilities": true,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testLibraryRead(b, s, testLibrarySetName)
+	require.NoError(t, err)
+	require.Equal(t, true, resp.Data["allow_unknown_capabilities"])
+
+	ids := resp.Data["application_key_ids"].([]string)
+	require.Len(t, ids, 1)
+	require.Equal(t, []string{"listFiles", "futureCapability"}, fake.key(ids[0]).Capabilities)
+}
+
+func testLibraryWrite(b logical.Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      libraryStoragePrefix + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testLibraryUpdate(b logical.Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      libraryStoragePrefix + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testLibraryRead(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      libraryStoragePrefix + name,
+		Storage:   s,
+	})
+}
+
+func testLibraryStatus(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      libraryStoragePrefix + name + "/status",
+		Storage:   s,
+	})
+}
+
+func testLibraryDelete(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      libraryStoragePrefix + name,
+		Storage:   s,
+	})
+}
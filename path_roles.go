@@ -3,6 +3,7 @@ package vault_plugin_secrets_backblazeb2
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,14 +17,24 @@ type backblazeB2RoleEntry struct {
 	// the capabilities this key will have in B2
 	Capabilities []string `json:"capabilities"`
 
+	// CapabilitySet is the capability set the role's keys take their
+	// capabilities from, if any. Capabilities holds them as of the last
+	// write, but the set is looked up again whenever a key is issued.
+	CapabilitySet string `json:"capability_set"`
+
 	// KeyNamePrefix is what we prepend to the key name when we
 	// create it, followed by the Vault request ID which asked
 	// for the key to be made
 	KeyNamePrefix string `json:"key_name_prefix"`
 
-	// BucketName is an optional restriction to limit this key to
-	// a particular bucket
-	BucketName string `json:"bucket_name"`
+	// BucketNames and BucketIDs are optional restrictions to limit
+	// this key to particular buckets, by name or by ID
+	BucketNames []string `json:"bucket_names"`
+	BucketIDs   []string `json:"bucket_ids"`
+
+	// BucketName is the single bucket of roles written before
+	// BucketNames existed, moved to BucketNames when read
+	BucketName string `json:"bucket_name,omitempty"`
 
 	// NamePrefix is an optional restriction to limit which object
 	// name prefixes this key can operate on
@@ -35,6 +46,65 @@ type backblazeB2RoleEntry struct {
 
 	// MaxTTL is the maximum any TTL can be for this role
 	MaxTTL time.Duration `json:"max_ttl"`
+
+	// Connection is the name of the connection keys are created
+	// with, empty for the mount's default config
+	Connection string `json:"connection"`
+
+	// KeyExpiration has B2 expire keys on its own once MaxTTL plus
+	// KeyExpirationGracePeriod has passed, in case Vault never
+	// revokes them
+	KeyExpiration            bool          `json:"key_expiration"`
+	KeyExpirationGracePeriod time.Duration `json:"key_expiration_grace_period"`
+
+	// AllowUnknownCapabilities skips checking Capabilities against
+	// the catalog, for capabilities B2 adds after this plugin is built
+	AllowUnknownCapabilities bool `json:"allow_unknown_capabilities"`
+
+	// AWSCredentialAliases adds the key to credentials a second time
+	// under the names AWS SDKs use for S3-compatible access
+	AWSCredentialAliases bool `json:"aws_credential_aliases"`
+}
+
+// defaultKeyNamePrefix is the key name prefix of roles which don't set
+// their own. Other mounts and users of the account may use it too.
+const defaultKeyNamePrefix = "vault-"
+
+// maxKeyLifetime is the longest B2 allows an application key to live for
+const maxKeyLifetime = 1000 * 24 * time.Hour
+
+// keyLifetime is how long B2 should keep keys issued for the role, zero
+// if they shouldn't expire
+func (r *backblazeB2RoleEntry) keyLifetime() time.Duration {
+	if !r.KeyExpiration {
+		return 0
+	}
+
+	return r.MaxTTL + r.KeyExpirationGracePeriod
+}
+
+// renderTemplates fills in the identity templates in the role's prefixes
+// for the entity requesting a key
+func (r *backblazeB2RoleEntry) renderTemplates(entity *logical.Entity, groups []*logical.Group) error {
+	keyNamePrefix, err := renderIdentityTemplate(r.KeyNamePrefix, entity, groups, keyNameTemplateValue)
+	if err != nil {
+		return fmt.Errorf("key_name_prefix: %w", err)
+	}
+
+	// Leave room for the UUID that follows the prefix
+	if len(keyNamePrefix)+36 > maxKeyNameLength {
+		return fmt.Errorf("key_name_prefix: rendered prefix %q is too long", keyNamePrefix)
+	}
+
+	namePrefix, err := renderIdentityTemplate(r.NamePrefix, entity, groups, namePrefixTemplateValue)
+	if err != nil {
+		return fmt.Errorf("name_prefix: %w", err)
+	}
+
+	r.KeyNamePrefix = keyNamePrefix
+	r.NamePrefix = namePrefix
+
+	return nil
 }
 
 // List the defined roles
@@ -76,13 +146,16 @@ func (b *backblazeB2Backend) pathRolesCRUD() *framework.Path {
 			},
 			"capabilities": {
 				Type:        framework.TypeCommaStringSlice,
-				Description: "Comma-separated list of capabilities",
-				Required:    true,
+				Description: "Comma-separated list of capabilities. Required unless capability_set is set.",
+			},
+			"capability_set": {
+				Type:        framework.TypeString,
+				Description: "Name of a built-in or stored capability set to take the capabilities from when keys are issued, instead of setting capabilities",
 			},
 			"key_name_prefix": {
 				Type:        framework.TypeString,
-				Description: "Prefix for key names generated by this role",
-				Default:     "vault-",
+				Description: "Prefix for key names generated by this role, which may use identity templates such as {{identity.entity.name}}",
+				Default:     defaultKeyNamePrefix,
 				Required:    false,
 			},
 			"bucket_name": {
@@ -90,9 +163,24 @@ func (b *backblazeB2Backend) pathRolesCRUD() *framework.Path {
 				Description: "Optional bucket name on which to restrict this key",
 				Required:    false,
 			},
+			"bucket_names": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Optional comma-separated list of bucket names on which to restrict this key",
+				Required:    false,
+			},
+			"bucket_id": {
+				Type:        framework.TypeString,
+				Description: "Optional bucket ID on which to restrict this key, saving a lookup of the bucket by name",
+				Required:    false,
+			},
+			"bucket_ids": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Optional comma-separated list of bucket IDs on which to restrict this key",
+				Required:    false,
+			},
 			"name_prefix": {
 				Type:        framework.TypeString,
-				Description: "Optional prefix to further restrict access to files whose names start with the prefix",
+				Description: "Optional prefix to further restrict access to files whose names start with the prefix, which may use identity templates such as {{identity.entity.name}}",
 				Required:    false,
 			},
 			"ttl": {
@@ -103,6 +191,28 @@ func (b *backblazeB2Backend) pathRolesCRUD() *framework.Path {
 				Type:        framework.TypeDurationSecond,
 				Description: "Optional maximum TTL to apply to keys",
 			},
+			"connection": {
+				Type:        framework.TypeString,
+				Description: "Optional name of the connection to create keys with. Defaults to the mount's config.",
+				Required:    false,
+			},
+			"key_expiration": {
+				Type:        framework.TypeBool,
+				Description: "Have B2 expire keys once max_ttl plus key_expiration_grace_period has passed, even if Vault never revokes them. Requires max_ttl.",
+			},
+			"key_expiration_grace_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long B2 keeps keys past max_ttl when key_expiration is set",
+				Default:     3600,
+			},
+			"allow_unknown_capabilities": {
+				Type:        framework.TypeBool,
+				Description: "Accept capabilities this plugin doesn't know about, for capabilities added to B2 since it was built",
+			},
+			"aws_credential_aliases": {
+				Type:        framework.TypeBool,
+				Description: "Also return credentials as aws_access_key_id and aws_secret_access_key, for S3-compatible clients",
+			},
 		},
 
 		ExistenceCheck: b.pathRoleExistsCheck,
@@ -146,13 +256,35 @@ func (b *backblazeB2Backend) pathRoleRead(ctx context.Context, req *logical.Requ
 		return nil, nil
 	}
 
+	if err := b.resolveCapabilitySet(ctx, req.Storage, entry); err != nil {
+		return nil, err
+	}
+
 	roleData := map[string]interface{}{
 		"key_name_prefix": entry.KeyNamePrefix,
 		"capabilities":    entry.Capabilities,
-		"bucket_name":     entry.BucketName,
+		"capability_set":  entry.CapabilitySet,
+		"bucket_name":     "",
+		"bucket_names":    entry.BucketNames,
+		"bucket_id":       "",
+		"bucket_ids":      entry.BucketIDs,
 		"name_prefix":     entry.NamePrefix,
 		"ttl":             entry.TTL.Seconds(),
 		"max_ttl":         entry.MaxTTL.Seconds(),
+		"connection":      entry.Connection,
+
+		"key_expiration":              entry.KeyExpiration,
+		"key_expiration_grace_period": entry.KeyExpirationGracePeriod.Seconds(),
+		"allow_unknown_capabilities":  entry.AllowUnknownCapabilities,
+		"aws_credential_aliases":      entry.AWSCredentialAliases,
+	}
+
+	if len(entry.BucketNames) == 1 {
+		roleData["bucket_name"] = entry.BucketNames[0]
+	}
+
+	if len(entry.BucketIDs) == 1 {
+		roleData["bucket_id"] = entry.BucketIDs[0]
 	}
 
 	return &logical.Response{
@@ -176,7 +308,7 @@ func (b *backblazeB2Backend) pathRoleWrite(ctx context.Context, req *logical.Req
 		r = &backblazeB2RoleEntry{}
 	}
 
-	keys := []string{"key_name_prefix", "bucket_name", "name_prefix"}
+	keys := []string{"key_name_prefix", "name_prefix", "connection"}
 
 	for _, key := range keys {
 
@@ -198,15 +330,50 @@ func (b *backblazeB2Backend) pathRoleWrite(ctx context.Context, req *logical.Req
 		switch key {
 		case "name_prefix":
 			r.NamePrefix = nv
-		case "bucket_name":
-			r.BucketName = nv
 		case "key_name_prefix":
 			r.KeyNamePrefix = nv
+		case "connection":
+			r.Connection = nv
 		}
 	}
 
-	if r.NamePrefix != "" && r.BucketName == "" {
-		return logical.ErrorResponse("bucket_name must be set if name_prefix is set"), nil
+	bucketNames, ok, err := getBucketList(d, "bucket_name", "bucket_names")
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if ok {
+		r.BucketNames = bucketNames
+	}
+
+	bucketIDs, ok, err := getBucketList(d, "bucket_id", "bucket_ids")
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if ok {
+		r.BucketIDs = bucketIDs
+	}
+
+	if err := validateIdentityTemplate(r.KeyNamePrefix); err != nil {
+		return logical.ErrorResponse("invalid template in key_name_prefix: %s", err), nil
+	}
+
+	if err := validateIdentityTemplate(r.NamePrefix); err != nil {
+		return logical.ErrorResponse("invalid template in name_prefix: %s", err), nil
+	}
+
+	if r.NamePrefix != "" && len(r.BucketNames) == 0 && len(r.BucketIDs) == 0 {
+		return logical.ErrorResponse("a bucket name or ID must be set if name_prefix is set"), nil
+	}
+
+	if r.Connection != defaultConnectionName {
+		c, err := b.getConnection(ctx, req.Storage, r.Connection)
+		if err != nil {
+			return nil, err
+		}
+
+		if c == nil {
+			return logical.ErrorResponse("connection %q does not exist", r.Connection), nil
+		}
 	}
 
 	// Handle TTLs
@@ -228,13 +395,76 @@ func (b *backblazeB2Backend) pathRoleWrite(ctx context.Context, req *logical.Req
 		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
 	}
 
+	// Handle key expiration
+	if v, ok := d.GetOk("key_expiration"); ok {
+		r.KeyExpiration = v.(bool)
+	}
+
+	if graceRaw, ok := d.GetOk("key_expiration_grace_period"); ok {
+		r.KeyExpirationGracePeriod = time.Duration(graceRaw.(int)) * time.Second
+	} else if createOperation {
+		r.KeyExpirationGracePeriod = time.Duration(d.Get("key_expiration_grace_period").(int)) * time.Second
+	}
+
+	if r.KeyExpirationGracePeriod < 0 {
+		return logical.ErrorResponse("key_expiration_grace_period cannot be negative"), nil
+	}
+
+	if r.KeyExpiration {
+		if r.MaxTTL == 0 {
+			return logical.ErrorResponse("max_ttl must be set if key_expiration is set"), nil
+		}
+
+		if r.keyLifetime() > maxKeyLifetime {
+			return logical.ErrorResponse("max_ttl plus key_expiration_grace_period cannot be more than %s", maxKeyLifetime), nil
+		}
+	}
+
 	// Handle capabilities
-	if c, ok := d.GetOk("capabilities"); ok {
+	c, capabilitiesSet := d.GetOk("capabilities")
+	set, capabilitySetSet := d.GetOk("capability_set")
+
+	switch {
+	case capabilitiesSet && capabilitySetSet:
+		return logical.ErrorResponse("only one of capabilities and capability_set may be set"), nil
+	case capabilitiesSet:
 		r.Capabilities = c.([]string)
+		r.CapabilitySet = ""
+	case capabilitySetSet:
+		r.CapabilitySet = strings.TrimSpace(set.(string))
+		if r.CapabilitySet == "" {
+			return logical.ErrorResponse("capability_set cannot be empty"), nil
+		}
+
+		capabilities, err := b.getCapabilitySet(ctx, req.Storage, r.CapabilitySet)
+		if err != nil {
+			return nil, err
+		}
+
+		if capabilities == nil {
+			return logical.ErrorResponse("capability set %q does not exist", r.CapabilitySet), nil
+		}
+
+		r.Capabilities = capabilities
 	}
 
 	if len(r.Capabilities) <= 0 {
-		return logical.ErrorResponse("capabilities must be set"), nil
+		return logical.ErrorResponse("capabilities or capability_set must be set"), nil
+	}
+
+	if v, ok := d.GetOk("allow_unknown_capabilities"); ok {
+		r.AllowUnknownCapabilities = v.(bool)
+	}
+
+	if v, ok := d.GetOk("aws_credential_aliases"); ok {
+		r.AWSCredentialAliases = v.(bool)
+	}
+
+	// Capability sets are checked when they are written
+	if !r.AllowUnknownCapabilities && r.CapabilitySet == "" {
+		if err := validateCapabilities(r.Capabilities); err != nil {
+			return logical.ErrorResponse("%s; set allow_unknown_capabilities to use capabilities newer than this plugin", err), nil
+		}
 	}
 
 	entry, err := logical.StorageEntryJSON("roles/"+role, &r)
@@ -282,5 +512,65 @@ func (b *backblazeB2Backend) getRole(ctx context.Context, s logical.Storage, rol
 		return nil, fmt.Errorf("unable to decode role %q: %w", role, err)
 	}
 
+	if rv.BucketName != "" {
+		if len(rv.BucketNames) == 0 {
+			rv.BucketNames = []string{rv.BucketName}
+		}
+		rv.BucketName = ""
+	}
+
 	return &rv, nil
 }
+
+// getBucketList reads a pair of fields giving one or several buckets,
+// such as bucket_name and bucket_names, reporting whether either was set
+func getBucketList(d *framework.FieldData, single, list string) ([]string, bool, error) {
+	listRaw, listSet := d.GetOk(list)
+	singleRaw, singleSet := d.GetOk(single)
+
+	switch {
+	case listSet && singleSet:
+		return nil, false, fmt.Errorf("only one of %s and %s may be set", single, list)
+	case listSet:
+		return normalizeBucketList(listRaw.([]string)), true, nil
+	case singleSet:
+		return normalizeBucketList([]string{singleRaw.(string)}), true, nil
+	}
+
+	return nil, false, nil
+}
+
+// normalizeBucketList trims bucket names or IDs, dropping empty and
+// duplicate entries
+func normalizeBucketList(names []string) []string {
+	var normalized []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name != "" && !slices.Contains(normalized, name) {
+			normalized = append(normalized, name)
+		}
+	}
+
+	return normalized
+}
+
+// resolveCapabilitySet updates the capabilities of a role which uses a
+// capability set to the set's current ones
+func (b *backblazeB2Backend) resolveCapabilitySet(ctx context.Context, s logical.Storage, r *backblazeB2RoleEntry) error {
+	if r.CapabilitySet == "" {
+		return nil
+	}
+
+	capabilities, err := b.getCapabilitySet(ctx, s, r.CapabilitySet)
+	if err != nil {
+		return err
+	}
+
+	if capabilities == nil {
+		return fmt.Errorf("capability set %q does not exist", r.CapabilitySet)
+	}
+
+	r.Capabilities = capabilities
+
+	return nil
+}
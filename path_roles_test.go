@@ -29,6 +29,7 @@ func TestRole(t *testing.T) {
 	err := testConfigCreate(b, s, map[string]interface{}{
 		"application_key_id": applicationKeyID,
 		"application_key":    applicationKey,
+		"skip_verify":        true,
 	})
 	assert.NoError(t, err)
 
@@ -105,6 +106,34 @@ func TestRole(t *testing.T) {
 
 	})
 
+	t.Run("Create User Role - fail on invalid key expiration", func(t *testing.T) {
+		typeValues := map[string]map[string]interface{}{
+			"Missing max_ttl": {
+				"key_expiration": true,
+			},
+			"Negative grace period": {
+				"key_expiration":              true,
+				"max_ttl":                     testMaxTTL,
+				"key_expiration_grace_period": "-1h",
+			},
+			"Longer than B2 allows": {
+				"key_expiration":              true,
+				"max_ttl":                     "24000h",
+				"key_expiration_grace_period": "1h",
+			},
+		}
+		for d, v := range typeValues {
+			t.Run(d, func(t *testing.T) {
+				v["capabilities"] = testApplicationKeyCapabilities
+				resp, err := testTokenRoleCreate(t, b, s, "expiring-role", v)
+
+				require.Nil(t, err)
+				require.NotNil(t, resp)
+				require.NotNil(t, resp.Error())
+			})
+		}
+	})
+
 	t.Run("Read User Role - existing", func(t *testing.T) {
 		resp, err := testTokenRoleRead(t, b, s, testRoleName)
 
@@ -115,6 +144,8 @@ func TestRole(t *testing.T) {
 		require.Equal(t, resp.Data["key_name_prefix"], testKeyNamePrefix)
 		require.Equal(t, resp.Data["bucket_name"], testBucketName)
 		require.Equal(t, resp.Data["name_prefix"], testNamePrefix)
+		require.Equal(t, resp.Data["key_expiration"], false)
+		require.Equal(t, resp.Data["key_expiration_grace_period"], float64(3600))
 	})
 
 	t.Run("Read User Role - non existent", func(t *testing.T) {
@@ -154,6 +185,114 @@ func TestRole(t *testing.T) {
 	})
 }
 
+func TestRoleCapabilities(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Unknown capability", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"capabilities": "listFiles,readFile",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+		require.Contains(t, resp.Error().Error(), `"readFile" (did you mean "readFiles"?)`)
+		require.Contains(t, resp.Error().Error(), "allow_unknown_capabilities")
+	})
+
+	t.Run("Newer capabilities", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"capabilities": "readBucketEncryption,writeFileLegalHolds,bypassGovernance",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+
+	t.Run("Override", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "future", map[string]interface{}{
+			"capabilities":               "listFiles,readFutureThings",
+			"allow_unknown_capabilities": true,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		// The override is kept for later updates
+		_, err = testTokenRoleUpdate(t, b, s, "future", map[string]interface{}{
+			"capabilities": "readFutureThings,writeFutureThings",
+		})
+		require.NoError(t, err)
+
+		resp, err = testTokenRoleRead(t, b, s, "future")
+		require.NoError(t, err)
+		require.Equal(t, true, resp.Data["allow_unknown_capabilities"])
+		require.Equal(t, []string{"readFutureThings", "writeFutureThings"}, resp.Data["capabilities"])
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/future",
+			Data: map[string]interface{}{
+				"allow_unknown_capabilities": false,
+			},
+			Storage: s,
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+}
+
+func TestRoleBucketNames(t *testing.T) {
+	b, s := getTestBackend(t)
+
+	t.Run("Multiple buckets", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"bucket_names": "data, logs,data,",
+			"name_prefix":  testNamePrefix,
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testTokenRoleRead(t, b, s, testRoleName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"data", "logs"}, resp.Data["bucket_names"])
+		require.Equal(t, "", resp.Data["bucket_name"])
+	})
+
+	t.Run("bucket_name replaces bucket_names", func(t *testing.T) {
+		_, err := testTokenRoleUpdate(t, b, s, testRoleName, map[string]interface{}{
+			"bucket_name": "data",
+		})
+		require.NoError(t, err)
+
+		resp, err := testTokenRoleRead(t, b, s, testRoleName)
+		require.NoError(t, err)
+		require.Equal(t, []string{"data"}, resp.Data["bucket_names"])
+		require.Equal(t, "data", resp.Data["bucket_name"])
+	})
+
+	t.Run("Both bucket_name and bucket_names", func(t *testing.T) {
+		resp, err := testTokenRoleCreate(t, b, s, "both", map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"bucket_name":  "data",
+			"bucket_names": "logs",
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Role with a single bucket_name in storage", func(t *testing.T) {
+		entry, err := logical.StorageEntryJSON("roles/legacy", map[string]interface{}{
+			"capabilities": testApplicationKeyCapabilities,
+			"bucket_name":  "data",
+		})
+		require.NoError(t, err)
+		require.NoError(t, s.Put(context.Background(), entry))
+
+		role, err := b.getRole(context.Background(), s, "legacy")
+		require.NoError(t, err)
+		require.Equal(t, []string{"data"}, role.BucketNames)
+		require.Empty(t, role.BucketName)
+	})
+}
+
 // Utility function to create a role while, returning any response (including errors).
 func testTokenRoleCreate(t *testing.T, b *backblazeB2Backend, s logical.Storage, roleName string, d map[string]interface{}) (*logical.Response, error) {
 	t.Helper()
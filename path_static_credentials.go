@@ -0,0 +1,64 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Define the R functions for the static credentials path
+func (b *backblazeB2Backend) pathStaticCredentials() *framework.Path {
+	return &framework.Path{
+		Pattern:      "static-creds/" + framework.GenericNameRegex("name"),
+		HelpSynopsis: "Read the current application key for a static role.",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of static role",
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathStaticCredentialsRead,
+			},
+		},
+	}
+}
+
+// pathStaticCredentialsRead returns a static role's current key, and how
+// long it has left before it is rotated
+func (b *backblazeB2Backend) pathStaticCredentialsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.staticRoleLocks, name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	r, err := b.getStaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if r == nil {
+		return logical.ErrorResponse("unknown static role %q", name), nil
+	}
+
+	ttl := time.Until(r.nextRotation())
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"application_key_id": r.ApplicationKeyId,
+			"application_key":    r.ApplicationKey,
+			"key_name":           r.KeyName,
+			"last_rotation_time": formatTime(r.LastRotation),
+			"rotation_period":    r.RotationPeriod.Seconds(),
+			"ttl":                int64(ttl.Seconds()),
+		},
+	}, nil
+}
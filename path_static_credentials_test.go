@@ -0,0 +1,62 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticCredentials(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+		"capabilities":    testApplicationKeyCapabilities,
+		"rotation_period": "1h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	readCreds := func(t *testing.T, name string) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "static-creds/" + name,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("Read Static Credentials", func(t *testing.T) {
+		resp := readCreds(t, testStaticRoleName)
+		require.Nil(t, resp.Secret)
+
+		key := fake.key(resp.Data["application_key_id"].(string))
+		require.NotNil(t, key)
+		require.Equal(t, key.Secret, resp.Data["application_key"])
+		require.Equal(t, "vault-"+testStaticRoleName, resp.Data["key_name"])
+		require.Equal(t, float64(3600), resp.Data["rotation_period"])
+		require.InDelta(t, 3600, resp.Data["ttl"], 5)
+
+		lastRotation, err := time.Parse(time.RFC3339, resp.Data["last_rotation_time"].(string))
+		require.NoError(t, err)
+		require.WithinDuration(t, time.Now(), lastRotation, time.Minute)
+	})
+
+	t.Run("Read Static Credentials - overdue", func(t *testing.T) {
+		role, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+		role.LastRotation = time.Now().Add(-2 * time.Hour)
+		require.NoError(t, b.saveStaticRole(context.Background(), s, testStaticRoleName, role))
+
+		resp := readCreds(t, testStaticRoleName)
+		require.Equal(t, int64(0), resp.Data["ttl"])
+	})
+
+	t.Run("Read Static Credentials - unknown role", func(t *testing.T) {
+		resp := readCreds(t, "missing")
+		require.True(t, resp.IsError())
+	})
+}
@@ -0,0 +1,489 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	staticRoleStoragePrefix = "static-roles/"
+
+	// minStaticRotationPeriod keeps static keys from being
+	// rotated more often than B2 and their users can cope with
+	minStaticRotationPeriod = time.Minute
+)
+
+// staticRoleEntry is a role with a single long-lived application key,
+// owned by Vault and rotated every RotationPeriod
+type staticRoleEntry struct {
+
+	// Capabilities is a list of strings which reflects
+	// the capabilities the key will have in B2
+	Capabilities []string `json:"capabilities"`
+
+	// AllowUnknownCapabilities skips checking Capabilities against
+	// the catalog, for capabilities B2 adds after this plugin is built
+	AllowUnknownCapabilities bool `json:"allow_unknown_capabilities"`
+
+	// KeyName is the name of the key in B2. Every rotation
+	// creates a key with the same name.
+	KeyName string `json:"key_name"`
+
+	// BucketName is an optional restriction to limit the key to
+	// a particular bucket
+	BucketName string `json:"bucket_name"`
+
+	// NamePrefix is an optional restriction to limit which object
+	// name prefixes the key can operate on
+	NamePrefix string `json:"name_prefix"`
+
+	// Connection is the name of the connection the key is created
+	// with, empty for the mount's default config
+	Connection string `json:"connection"`
+
+	// RotationPeriod is how long the key is used before being replaced
+	RotationPeriod time.Duration `json:"rotation_period"`
+
+	// ApplicationKeyId and ApplicationKey are the current key
+	ApplicationKeyId string `json:"application_key_id"`
+	ApplicationKey   string `json:"application_key"`
+
+	// LastRotation is when the current key was created
+	LastRotation time.Time `json:"last_rotation"`
+}
+
+// keyRole describes the static role's key in the form expected by
+// b2ApplicationKeyCreate
+func (r *staticRoleEntry) keyRole() backblazeB2RoleEntry {
+	return backblazeB2RoleEntry{
+		Capabilities: r.Capabilities,
+		BucketNames:  normalizeBucketList([]string{r.BucketName}),
+		NamePrefix:   r.NamePrefix,
+		Connection:   r.Connection,
+	}
+}
+
+// nextRotation returns when the current key is due to be replaced
+func (r *staticRoleEntry) nextRotation() time.Time {
+	return r.LastRotation.Add(r.RotationPeriod)
+}
+
+// List the defined static roles
+func (b *backblazeB2Backend) pathStaticRoles() *framework.Path {
+	return &framework.Path{
+		Pattern:      "static-roles/?",
+		HelpSynopsis: "List configured static roles.",
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ListOperation: &framework.PathOperation{
+				Callback: b.pathStaticRolesList,
+			},
+		},
+	}
+}
+
+// pathStaticRolesList lists the currently defined static roles
+func (b *backblazeB2Backend) pathStaticRolesList(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	roles, err := req.Storage.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve list of static roles: %w", err)
+	}
+
+	return logical.ListResponse(roles), nil
+}
+
+// Define the CRUD functions for the static roles path
+func (b *backblazeB2Backend) pathStaticRolesCRUD() *framework.Path {
+	return &framework.Path{
+		Pattern:         "static-roles/" + framework.GenericNameRegex("name"),
+		HelpSynopsis:    "Configure a Backblaze B2 static role.",
+		HelpDescription: "Use this endpoint to manage a long-lived application key which Vault creates, stores and rotates on a schedule.",
+
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Static role name",
+				Required:    true,
+			},
+			"capabilities": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Comma-separated list of capabilities",
+				Required:    true,
+			},
+			"allow_unknown_capabilities": {
+				Type:        framework.TypeBool,
+				Description: "Accept capabilities this plugin doesn't know about, for capabilities added to B2 since it was built",
+			},
+			"key_name": {
+				Type:        framework.TypeString,
+				Description: "Name of the key in B2. Defaults to vault- followed by the role name.",
+				Required:    false,
+			},
+			"bucket_name": {
+				Type:        framework.TypeString,
+				Description: "Optional bucket name on which to restrict the key",
+				Required:    false,
+			},
+			"name_prefix": {
+				Type:        framework.TypeString,
+				Description: "Optional prefix to further restrict access to files whose names start with the prefix",
+				Required:    false,
+			},
+			"connection": {
+				Type:        framework.TypeString,
+				Description: "Optional name of the connection to create the key with. Defaults to the mount's config.",
+				Required:    false,
+			},
+			"rotation_period": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long the key is used before it is replaced. Must be at least one minute.",
+				Required:    true,
+			},
+		},
+
+		ExistenceCheck: b.pathStaticRoleExistsCheck,
+
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.CreateOperation: &framework.PathOperation{
+				Callback: b.pathStaticRoleWrite,
+			},
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathStaticRoleRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathStaticRoleWrite,
+			},
+			logical.DeleteOperation: &framework.PathOperation{
+				Callback: b.pathStaticRoleDelete,
+			},
+		},
+	}
+}
+
+// pathStaticRoleExistsCheck checks to see if a static role exists
+func (b *backblazeB2Backend) pathStaticRoleExistsCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	entry, err := b.getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+
+	return entry != nil, nil
+}
+
+// pathStaticRoleRead reads information on a current static role
+func (b *backblazeB2Backend) pathStaticRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := b.getStaticRole(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"capabilities":               entry.Capabilities,
+			"allow_unknown_capabilities": entry.AllowUnknownCapabilities,
+			"key_name":                   entry.KeyName,
+			"bucket_name":                entry.BucketName,
+			"name_prefix":                entry.NamePrefix,
+			"connection":                 entry.Connection,
+			"rotation_period":            entry.RotationPeriod.Seconds(),
+			"application_key_id":         entry.ApplicationKeyId,
+			"last_rotation_time":         formatTime(entry.LastRotation),
+		},
+	}, nil
+}
+
+// pathStaticRoleWrite creates/updates a static role. Creating a role
+// creates its key, and changing anything about the key replaces it, as
+// B2 keys can't be modified.
+func (b *backblazeB2Backend) pathStaticRoleWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.staticRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.getStaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous *staticRoleEntry
+	if r == nil {
+		r = &staticRoleEntry{
+			KeyName: "vault-" + name,
+		}
+	} else {
+		p := *r
+		previous = &p
+	}
+
+	for _, key := range []string{"key_name", "bucket_name", "name_prefix", "connection"} {
+		v, ok := d.GetOk(key)
+		if !ok {
+			continue
+		}
+
+		nv := strings.TrimSpace(v.(string))
+
+		switch key {
+		case "key_name":
+			if nv == "" {
+				nv = "vault-" + name
+			}
+			r.KeyName = nv
+		case "bucket_name":
+			r.BucketName = nv
+		case "name_prefix":
+			r.NamePrefix = nv
+		case "connection":
+			r.Connection = nv
+		}
+	}
+
+	if c, ok := d.GetOk("capabilities"); ok {
+		r.Capabilities = c.([]string)
+	}
+
+	if len(r.Capabilities) <= 0 {
+		return logical.ErrorResponse("capabilities must be set"), nil
+	}
+
+	if v, ok := d.GetOk("allow_unknown_capabilities"); ok {
+		r.AllowUnknownCapabilities = v.(bool)
+	}
+
+	if !r.AllowUnknownCapabilities {
+		if err := validateCapabilities(r.Capabilities); err != nil {
+			return logical.ErrorResponse("%s; set allow_unknown_capabilities to use capabilities newer than this plugin", err), nil
+		}
+	}
+
+	if r.NamePrefix != "" && r.BucketName == "" {
+		return logical.ErrorResponse("bucket_name must be set if name_prefix is set"), nil
+	}
+
+	if periodRaw, ok := d.GetOk("rotation_period"); ok {
+		r.RotationPeriod = time.Duration(periodRaw.(int)) * time.Second
+	}
+
+	if r.RotationPeriod < minStaticRotationPeriod {
+		return logical.ErrorResponse("rotation_period must be at least %s", minStaticRotationPeriod), nil
+	}
+
+	if r.Connection != defaultConnectionName {
+		c, err := b.getConnection(ctx, req.Storage, r.Connection)
+		if err != nil {
+			return nil, err
+		}
+
+		if c == nil {
+			return logical.ErrorResponse("connection %q does not exist", r.Connection), nil
+		}
+	}
+
+	// Only the rotation period can change without a new key
+	if previous != nil && !previous.keyChanged(r) {
+		if err := b.saveStaticRole(ctx, req.Storage, name, r); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+
+	if err := b.rotateStaticRole(ctx, req.Storage, name, r, previous); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// keyChanged reports whether an updated role needs a different key
+func (r *staticRoleEntry) keyChanged(updated *staticRoleEntry) bool {
+	return r.KeyName != updated.KeyName ||
+		r.BucketName != updated.BucketName ||
+		r.NamePrefix != updated.NamePrefix ||
+		r.Connection != updated.Connection ||
+		strings.Join(r.Capabilities, ",") != strings.Join(updated.Capabilities, ",")
+}
+
+// pathStaticRoleDelete deletes a static role along with its key
+func (b *backblazeB2Backend) pathStaticRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.staticRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.getStaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if r == nil {
+		return nil, nil
+	}
+
+	client, err := b.getConnectionClient(ctx, req.Storage, r.Connection)
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete the key first, so a failure leaves the role in place
+	// and the delete can be retried
+	if err := client.DeleteKey(ctx, r.ApplicationKeyId); err != nil {
+		return nil, fmt.Errorf("failed to delete application key: %w", err)
+	}
+
+	if err := req.Storage.Delete(ctx, staticRoleStoragePrefix+name); err != nil {
+		return nil, fmt.Errorf("failed to delete static role from storage: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (b *backblazeB2Backend) getStaticRole(ctx context.Context, s logical.Storage, name string) (*staticRoleEntry, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing static role name")
+	}
+
+	entry, err := s.Get(ctx, staticRoleStoragePrefix+name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve static role %q: %w", name, err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	var r staticRoleEntry
+	if err := entry.DecodeJSON(&r); err != nil {
+		return nil, fmt.Errorf("unable to decode static role %q: %w", name, err)
+	}
+
+	return &r, nil
+}
+
+func (b *backblazeB2Backend) saveStaticRole(ctx context.Context, s logical.Storage, name string, r *staticRoleEntry) error {
+	entry, err := logical.StorageEntryJSON(staticRoleStoragePrefix+name, r)
+	if err != nil {
+		return fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("failed to write entry to storage: %w", err)
+	}
+
+	return nil
+}
+
+// staticRotationWALKind is the WAL entry kind written while a static
+// role's application key is being replaced
+const staticRotationWALKind = "staticRotation"
+
+// staticRotationWAL records an in-flight static role rotation so that it
+// can be completed or undone if Vault stops part way through. The old key
+// may belong to a different connection if the role's connection changed.
+type staticRotationWAL struct {
+	Role string `json:"role" mapstructure:"role"`
+
+	keyReplacementWAL `mapstructure:",squash"`
+}
+
+// rotateStaticRole creates a new key for a static role, stores it and
+// deletes the key in previous, if any. The caller must hold the role's lock.
+func (b *backblazeB2Backend) rotateStaticRole(ctx context.Context, s logical.Storage, name string, r *staticRoleEntry, previous *staticRoleEntry) error {
+	wal := &staticRotationWAL{Role: name}
+	wal.NewConnection = r.Connection
+	wal.NewKeyName = r.KeyName
+
+	if previous != nil {
+		wal.OldConnection = previous.Connection
+		wal.OldApplicationKeyId = previous.ApplicationKeyId
+	}
+
+	create := func() (*b2Key, error) {
+		return b.b2ApplicationKeyCreate(ctx, s, r.KeyName, r.keyRole())
+	}
+
+	store := func(newKey *b2Key) error {
+		r.ApplicationKeyId = newKey.ID
+		r.ApplicationKey = newKey.Secret
+		r.LastRotation = time.Now()
+
+		return b.saveStaticRole(ctx, s, name, r)
+	}
+
+	return b.replaceKey(ctx, s, staticRotationWALKind, wal, false, create, store)
+}
+
+// staticRotationRollback finishes or undoes a static role rotation that was
+// interrupted. If the role is gone, both its old and new keys are deleted.
+func (b *backblazeB2Backend) staticRotationRollback(ctx context.Context, req *logical.Request, data interface{}) error {
+	var entry staticRotationWAL
+	if err := mapstructure.Decode(data, &entry); err != nil {
+		return err
+	}
+
+	lock := locksutil.LockForKey(b.staticRoleLocks, entry.Role)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.getStaticRole(ctx, req.Storage, entry.Role)
+	if err != nil {
+		return err
+	}
+
+	return b.rollbackKeyReplacement(ctx, req.Storage, b.Logger().With("role", entry.Role), &entry.keyReplacementWAL, func(id string) bool {
+		return r != nil && r.ApplicationKeyId == id
+	})
+}
+
+// rotateStaticRolesIfDue is called periodically and rotates every static
+// role whose key has reached the end of its rotation period
+func (b *backblazeB2Backend) rotateStaticRolesIfDue(ctx context.Context, s logical.Storage) error {
+	names, err := s.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve list of static roles: %w", err)
+	}
+
+	var errs []error
+	for _, name := range names {
+		if err := b.rotateStaticRoleIfDue(ctx, s, name); err != nil {
+			b.Logger().Error("Error rotating static role", "role", name, "error", err)
+			errs = append(errs, fmt.Errorf("static role %q: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *backblazeB2Backend) rotateStaticRoleIfDue(ctx context.Context, s logical.Storage, name string) error {
+	lock := locksutil.LockForKey(b.staticRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.getStaticRole(ctx, s, name)
+	if err != nil {
+		return err
+	}
+
+	if r == nil || time.Now().Before(r.nextRotation()) {
+		return nil
+	}
+
+	b.Logger().Info("Rotating static role key on schedule", "role", name)
+
+	previous := *r
+	return b.rotateStaticRole(ctx, s, name, r, &previous)
+}
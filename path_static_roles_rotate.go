@@ -0,0 +1,65 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// Define the rotate path for static roles
+func (b *backblazeB2Backend) pathStaticRoleRotate() *framework.Path {
+	return &framework.Path{
+		Pattern:         "rotate-role/" + framework.GenericNameRegex("name"),
+		HelpSynopsis:    "Immediately replace the application key of a static role",
+		HelpDescription: "Use this endpoint to create a new application key for a static role and delete the current one, for example after a suspected leak",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeString,
+				Description: "Name of static role",
+				Required:    true,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathStaticRoleRotateUpdate,
+			},
+		},
+	}
+}
+
+// Rotate the static role's key
+func (b *backblazeB2Backend) pathStaticRoleRotateUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	// Concurrent requests for the same role queue up here, and each
+	// rotates from whatever key the previous one left in place
+	lock := locksutil.LockForKey(b.staticRoleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	r, err := b.getStaticRole(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if r == nil {
+		return logical.ErrorResponse("unknown static role %q", name), nil
+	}
+
+	b.Logger().Info("Rotating static role key on request", "role", name)
+
+	previous := *r
+	if err := b.rotateStaticRole(ctx, req.Storage, name, r, &previous); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"application_key_id":          r.ApplicationKeyId,
+			"previous_application_key_id": previous.ApplicationKeyId,
+			"last_rotation_time":          formatTime(r.LastRotation),
+		},
+	}, nil
+}
@@ -0,0 +1,106 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticRoleRotate(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+		"capabilities":    testApplicationKeyCapabilities,
+		"rotation_period": "24h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	rotate := func(name string) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "rotate-role/" + name,
+			Storage:   s,
+		})
+	}
+
+	t.Run("Rotate - pass", func(t *testing.T) {
+		before, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+
+		resp, err := rotate(testStaticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, before.ApplicationKeyId, resp.Data["previous_application_key_id"])
+
+		newID := resp.Data["application_key_id"].(string)
+		require.NotEqual(t, before.ApplicationKeyId, newID)
+		require.Nil(t, fake.key(before.ApplicationKeyId))
+
+		key := fake.key(newID)
+		require.NotNil(t, key)
+		require.Equal(t, testApplicationKeyCapabilities, key.Capabilities)
+
+		after, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, newID, after.ApplicationKeyId)
+		require.Equal(t, key.Secret, after.ApplicationKey)
+		require.True(t, after.LastRotation.After(before.LastRotation))
+	})
+
+	t.Run("Rotate - unknown role", func(t *testing.T) {
+		resp, err := rotate("missing")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("Rotate - B2 failure keeps current key", func(t *testing.T) {
+		before, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+
+		fake.createErr = errors.New("simulated B2 failure")
+		defer func() { fake.createErr = nil }()
+
+		_, err = rotate(testStaticRoleName)
+		require.Error(t, err)
+
+		after, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, before.ApplicationKeyId, after.ApplicationKeyId)
+		require.NotNil(t, fake.key(before.ApplicationKeyId))
+	})
+
+	t.Run("Rotate - concurrent requests", func(t *testing.T) {
+		const requests = 10
+
+		var wg sync.WaitGroup
+		errs := make(chan error, requests)
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := rotate(testStaticRoleName)
+				if err == nil && resp.IsError() {
+					err = resp.Error()
+				}
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+
+		// Every rotation deleted the key before it, leaving only the
+		// root key and the role's current key
+		role, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+		require.NotNil(t, fake.key(role.ApplicationKeyId))
+		require.Len(t, fake.keys, 2)
+	})
+}
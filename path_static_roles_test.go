@@ -0,0 +1,387 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+const testStaticRoleName = "test-static-role"
+
+func TestStaticRole(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+	fake.addBucket("backups")
+
+	var keyID string
+
+	t.Run("Create Static Role - invalid", func(t *testing.T) {
+		typeValues := map[string]map[string]interface{}{
+			"Missing capabilities": {
+				"rotation_period": "1h",
+			},
+			"Missing rotation_period": {
+				"capabilities": testApplicationKeyCapabilities,
+			},
+			"Short rotation_period": {
+				"capabilities":    testApplicationKeyCapabilities,
+				"rotation_period": "10s",
+			},
+			"Name prefix without bucket": {
+				"capabilities":    testApplicationKeyCapabilities,
+				"rotation_period": "1h",
+				"name_prefix":     "logs/",
+			},
+			"Unknown connection": {
+				"capabilities":    testApplicationKeyCapabilities,
+				"rotation_period": "1h",
+				"connection":      "missing",
+			},
+			"Unknown capability": {
+				"capabilities":    []string{"listFiles", "readFile"},
+				"rotation_period": "1h",
+			},
+		}
+		for d, v := range typeValues {
+			t.Run(d, func(t *testing.T) {
+				resp, err := testStaticRoleWrite(b, s, testStaticRoleName, v)
+				require.NoError(t, err)
+				require.True(t, resp.IsError())
+			})
+		}
+
+		require.Len(t, fake.keys, 1)
+	})
+
+	t.Run("Create Static Role - pass", func(t *testing.T) {
+		resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+			"capabilities":    testApplicationKeyCapabilities,
+			"bucket_name":     "backups",
+			"name_prefix":     "logs/",
+			"rotation_period": "24h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testStaticRoleRead(b, s, testStaticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, "vault-"+testStaticRoleName, resp.Data["key_name"])
+		require.Equal(t, float64(86400), resp.Data["rotation_period"])
+		require.NotEmpty(t, resp.Data["last_rotation_time"])
+		require.NotContains(t, resp.Data, "application_key")
+
+		keyID = resp.Data["application_key_id"].(string)
+		key := fake.key(keyID)
+		require.NotNil(t, key)
+		require.Equal(t, "vault-"+testStaticRoleName, key.Name)
+		require.Equal(t, testApplicationKeyCapabilities, key.Capabilities)
+		require.Equal(t, []string{"backups"}, key.BucketNames)
+		require.Equal(t, "logs/", key.NamePrefix)
+	})
+
+	t.Run("List Static Roles", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      staticRoleStoragePrefix,
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{testStaticRoleName}, resp.Data["keys"])
+	})
+
+	t.Run("Update Static Role - rotation period keeps key", func(t *testing.T) {
+		resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+			"rotation_period": "48h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testStaticRoleRead(b, s, testStaticRoleName)
+		require.NoError(t, err)
+		require.Equal(t, keyID, resp.Data["application_key_id"])
+		require.Equal(t, float64(172800), resp.Data["rotation_period"])
+	})
+
+	t.Run("Update Static Role - capabilities replace key", func(t *testing.T) {
+		resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+			"capabilities": "listFiles,readFiles",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		resp, err = testStaticRoleRead(b, s, testStaticRoleName)
+		require.NoError(t, err)
+		require.NotEqual(t, keyID, resp.Data["application_key_id"])
+		require.Nil(t, fake.key(keyID))
+
+		keyID = resp.Data["application_key_id"].(string)
+		require.Equal(t, []string{"listFiles", "readFiles"}, fake.key(keyID).Capabilities)
+	})
+
+	t.Run("Delete Connection - in use", func(t *testing.T) {
+		_, err := testConnectionWrite(b, s, "prod", map[string]interface{}{
+			"application_key_id": applicationKeyID,
+			"application_key":    applicationKey,
+			"skip_verify":        true,
+		})
+		require.NoError(t, err)
+
+		resp, err := testStaticRoleWrite(b, s, "prod-role", map[string]interface{}{
+			"capabilities":    "listFiles",
+			"rotation_period": "1h",
+			"connection":      "prod",
+		})
+		require.Error(t, err)
+		require.Nil(t, resp)
+
+		// The connection's made up key can't create keys, so
+		// store the role directly
+		err = b.saveStaticRole(context.Background(), s, "prod-role", &staticRoleEntry{
+			Capabilities:   []string{"listFiles"},
+			Connection:     "prod",
+			RotationPeriod: time.Hour,
+		})
+		require.NoError(t, err)
+
+		resp, err = testConnectionDelete(b, s, "prod")
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+
+		require.NoError(t, s.Delete(context.Background(), staticRoleStoragePrefix+"prod-role"))
+	})
+
+	t.Run("Delete Static Role - B2 failure", func(t *testing.T) {
+		fake.deleteErr = errors.New("simulated B2 failure")
+		defer func() { fake.deleteErr = nil }()
+
+		_, err := testStaticRoleDelete(b, s, testStaticRoleName)
+		require.Error(t, err)
+
+		role, err := b.getStaticRole(context.Background(), s, testStaticRoleName)
+		require.NoError(t, err)
+		require.NotNil(t, role)
+	})
+
+	t.Run("Delete Static Role - pass", func(t *testing.T) {
+		resp, err := testStaticRoleDelete(b, s, testStaticRoleName)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+		require.Nil(t, fake.key(keyID))
+
+		resp, err = testStaticRoleRead(b, s, testStaticRoleName)
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	})
+}
+
+func TestStaticRoleScheduledRotation(t *testing.T) {
+	ctx := context.Background()
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	for _, name := range []string{"due", "not-due"} {
+		resp, err := testStaticRoleWrite(b, s, name, map[string]interface{}{
+			"capabilities":    "listFiles",
+			"rotation_period": "1h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+	}
+
+	due, err := b.getStaticRole(ctx, s, "due")
+	require.NoError(t, err)
+	due.LastRotation = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, b.saveStaticRole(ctx, s, "due", due))
+
+	notDue, err := b.getStaticRole(ctx, s, "not-due")
+	require.NoError(t, err)
+
+	err = b.periodicFunc(ctx, &logical.Request{Storage: s})
+	require.NoError(t, err)
+
+	rotated, err := b.getStaticRole(ctx, s, "due")
+	require.NoError(t, err)
+	require.NotEqual(t, due.ApplicationKeyId, rotated.ApplicationKeyId)
+	require.True(t, rotated.LastRotation.After(due.LastRotation))
+	require.Nil(t, fake.key(due.ApplicationKeyId))
+	require.NotNil(t, fake.key(rotated.ApplicationKeyId))
+
+	unchanged, err := b.getStaticRole(ctx, s, "not-due")
+	require.NoError(t, err)
+	require.Equal(t, notDue.ApplicationKeyId, unchanged.ApplicationKeyId)
+
+	ids, err := framework.ListWAL(ctx, s)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+}
+
+func TestStaticRotationWALRollback(t *testing.T) {
+	ctx := context.Background()
+
+	setup := func(t *testing.T) (*backblazeB2Backend, logical.Storage, *fakeB2, *staticRoleEntry) {
+		b, s, fake := getTestBackendWithFakeB2(t)
+
+		resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+			"capabilities":    "listFiles",
+			"rotation_period": "1h",
+		})
+		require.NoError(t, err)
+		require.Nil(t, resp)
+
+		role, err := b.getStaticRole(ctx, s, testStaticRoleName)
+		require.NoError(t, err)
+
+		return b, s, fake, role
+	}
+
+	rollback := func(t *testing.T, b *backblazeB2Backend, s logical.Storage, wal *staticRotationWAL) {
+		walID, err := framework.PutWAL(ctx, s, staticRotationWALKind, wal)
+		require.NoError(t, err)
+
+		entry, err := framework.GetWAL(ctx, s, walID)
+		require.NoError(t, err)
+
+		err = b.walRollback(ctx, &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		require.NoError(t, err)
+	}
+
+	newKey := func(t *testing.T, fake *fakeB2) *b2Key {
+		key, err := fake.addKey("vault-"+testStaticRoleName, b2KeyOptions{Capabilities: []string{"listFiles"}})
+		require.NoError(t, err)
+		return key
+	}
+
+	t.Run("Crash before role is written", func(t *testing.T) {
+		b, s, fake, role := setup(t)
+		halfCreated := newKey(t, fake)
+
+		rollback(t, b, s, &staticRotationWAL{
+			Role: testStaticRoleName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: role.ApplicationKeyId,
+				NewApplicationKeyId: halfCreated.ID,
+			},
+		})
+
+		require.NotNil(t, fake.key(role.ApplicationKeyId))
+		require.Nil(t, fake.key(halfCreated.ID))
+	})
+
+	t.Run("Crash before key ID is recorded", func(t *testing.T) {
+		b, s, fake, role := setup(t)
+		halfCreated := newKey(t, fake)
+
+		rollback(t, b, s, &staticRotationWAL{
+			Role: testStaticRoleName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: role.ApplicationKeyId,
+				NewKeyName:          halfCreated.Name,
+				ExistingKeyIds:      []string{role.ApplicationKeyId},
+			},
+		})
+
+		require.NotNil(t, fake.key(role.ApplicationKeyId))
+		require.Nil(t, fake.key(halfCreated.ID))
+	})
+
+	t.Run("Crash before old key is deleted", func(t *testing.T) {
+		b, s, fake, role := setup(t)
+		old := newKey(t, fake)
+
+		rollback(t, b, s, &staticRotationWAL{
+			Role: testStaticRoleName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: old.ID,
+				NewApplicationKeyId: role.ApplicationKeyId,
+			},
+		})
+
+		require.Nil(t, fake.key(old.ID))
+		require.NotNil(t, fake.key(role.ApplicationKeyId))
+	})
+
+	t.Run("Role deleted", func(t *testing.T) {
+		b, s, fake, role := setup(t)
+		require.NoError(t, s.Delete(ctx, staticRoleStoragePrefix+testStaticRoleName))
+		halfCreated := newKey(t, fake)
+
+		rollback(t, b, s, &staticRotationWAL{
+			Role: testStaticRoleName,
+			keyReplacementWAL: keyReplacementWAL{
+				OldApplicationKeyId: role.ApplicationKeyId,
+				NewApplicationKeyId: halfCreated.ID,
+			},
+		})
+
+		require.Nil(t, fake.key(role.ApplicationKeyId))
+		require.Nil(t, fake.key(halfCreated.ID))
+	})
+
+	t.Run("Old key delete fails during rotation", func(t *testing.T) {
+		b, s, fake, role := setup(t)
+		fake.deleteErr = errors.New("simulated B2 failure")
+
+		previous := *role
+		err := b.rotateStaticRole(ctx, s, testStaticRoleName, role, &previous)
+		require.Error(t, err)
+		require.NotNil(t, fake.key(previous.ApplicationKeyId))
+
+		ids, err := framework.ListWAL(ctx, s)
+		require.NoError(t, err)
+		require.Len(t, ids, 1)
+
+		fake.deleteErr = nil
+		entry, err := framework.GetWAL(ctx, s, ids[0])
+		require.NoError(t, err)
+
+		err = b.walRollback(ctx, &logical.Request{Storage: s}, entry.Kind, entry.Data)
+		require.NoError(t, err)
+		require.Nil(t, fake.key(previous.ApplicationKeyId))
+		require.NotNil(t, fake.key(role.ApplicationKeyId))
+	})
+}
+
+func TestStaticRoleUnknownCapabilities(t *testing.T) {
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+		"capabilities":               []string{"listFiles", "futureCapability"},
+		"allow_unknown_capabilities": true,
+		"rotation_period":            "1h",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	resp, err = testStaticRoleRead(b, s, testStaticRoleName)
+	require.NoError(t, err)
+	require.Equal(t, true, resp.Data["allow_unknown_capabilities"])
+	require.Equal(t, []string{"listFiles", "futureCapability"}, fake.key(resp.Data["application_key_id"].(string)).Capabilities)
+}
+
+func testStaticRoleWrite(b logical.Backend, s logical.Storage, name string, d map[string]interface{}) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      staticRoleStoragePrefix + name,
+		Data:      d,
+		Storage:   s,
+	})
+}
+
+func testStaticRoleRead(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      staticRoleStoragePrefix + name,
+		Storage:   s,
+	})
+}
+
+func testStaticRoleDelete(b logical.Backend, s logical.Storage, name string) (*logical.Response, error) {
+	return b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      staticRoleStoragePrefix + name,
+		Storage:   s,
+	})
+}
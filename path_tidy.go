@@ -0,0 +1,648 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	autoTidyConfigStoragePath = "config/auto-tidy"
+	tidyStateStoragePath      = "tidy-state"
+
+	defaultTidySafetyBuffer = time.Hour
+	defaultAutoTidyInterval = 24 * time.Hour
+
+	// minTidySafetyBuffer gives keys being issued or rotated time to be
+	// recorded, or their rotation rolled back, before tidy may delete them
+	minTidySafetyBuffer = walRollbackMinAge
+)
+
+// autoTidyConfig controls the periodic tidy of orphaned keys
+type autoTidyConfig struct {
+	Enabled              bool          `json:"enabled"`
+	Interval             time.Duration `json:"interval"`
+	SafetyBuffer         time.Duration `json:"safety_buffer"`
+	IncludeDefaultPrefix bool          `json:"include_default_prefix"`
+}
+
+// tidyState is what tidy remembers between runs. B2 doesn't say when a
+// key was created, so the safety buffer counts from when tidy first
+// found each orphan.
+type tidyState struct {
+	LastRun   time.Time            `json:"last_run"`
+	FirstSeen map[string]time.Time `json:"first_seen"`
+
+	// Listed has the connections whose keys tidy has listed. Orphans
+	// found the first time a connection is listed may have been issued
+	// before the mount kept records of keys, with leases still live, so
+	// they are kept in Preexisting, by connection, and only deleted when
+	// asked to.
+	Listed      map[string]bool   `json:"listed"`
+	Preexisting map[string]string `json:"preexisting"`
+}
+
+// orphanedKey is a key in B2 named like a role's keys which the mount
+// doesn't know about
+type orphanedKey struct {
+	ApplicationKeyId string
+	Name             string
+	Connection       string
+	FirstSeen        time.Time
+	Preexisting      bool
+}
+
+// tidyReport describes what a tidy found and deleted
+type tidyReport struct {
+	Orphans []orphanedKey
+
+	// Deleted lists the keys deleted, or that would have been on a
+	// dry run
+	Deleted []string
+
+	// ExpiredRecords lists the issued key records whose leases have
+	// expired, which are deleted unless on a dry run
+	ExpiredRecords []string
+
+	// Warnings describes connections which couldn't be checked and
+	// orphans which couldn't be deleted
+	Warnings []string
+}
+
+const includeDefaultPrefixDescription = "Also match keys named with the default key name prefix " + defaultKeyNamePrefix +
+	", which other mounts and users of the account may use too"
+
+func (b *backblazeB2Backend) pathTidy() *framework.Path {
+	return &framework.Path{
+		Pattern:         "tidy",
+		HelpSynopsis:    "Delete application keys left behind in B2.",
+		HelpDescription: "Use this endpoint to find keys in B2 named with a role's key_name_prefix which this mount doesn't hold a lease for, and delete them.",
+		Fields: map[string]*framework.FieldSchema{
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Report what would be deleted without deleting anything",
+			},
+			"include_preexisting": {
+				Type:        framework.TypeBool,
+				Description: "Also delete orphans found the first time a connection's keys were listed, which may have been issued before the mount kept records of keys",
+			},
+			"include_default_prefix": {
+				Type:        framework.TypeBool,
+				Description: includeDefaultPrefixDescription,
+			},
+			"safety_buffer": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long a key must have been found orphaned before it is deleted. Must be at least five minutes.",
+				Default:     int(defaultTidySafetyBuffer.Seconds()),
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathTidyUpdate,
+			},
+		},
+	}
+}
+
+func (b *backblazeB2Backend) pathAutoTidyConfig() *framework.Path {
+	return &framework.Path{
+		Pattern:         "config/auto-tidy",
+		HelpSynopsis:    "Configure the periodic tidy of application keys left behind in B2.",
+		HelpDescription: "Use this endpoint to have the tidy endpoint run on a schedule.",
+		Fields: map[string]*framework.FieldSchema{
+			"enabled": {
+				Type:        framework.TypeBool,
+				Description: "Whether to tidy periodically",
+			},
+			"interval": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How often to tidy",
+				Default:     int(defaultAutoTidyInterval.Seconds()),
+			},
+			"safety_buffer": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long a key must have been found orphaned before it is deleted. Must be at least five minutes.",
+				Default:     int(defaultTidySafetyBuffer.Seconds()),
+			},
+			"include_default_prefix": {
+				Type:        framework.TypeBool,
+				Description: includeDefaultPrefixDescription,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.ReadOperation: &framework.PathOperation{
+				Callback: b.pathAutoTidyConfigRead,
+			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback: b.pathAutoTidyConfigWrite,
+			},
+		},
+	}
+}
+
+func (b *backblazeB2Backend) pathTidyUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	safetyBuffer := time.Duration(d.Get("safety_buffer").(int)) * time.Second
+	if safetyBuffer < minTidySafetyBuffer {
+		return logical.ErrorResponse("safety_buffer must be at least %s", minTidySafetyBuffer), nil
+	}
+
+	opts := tidyOptions{
+		SafetyBuffer:         safetyBuffer,
+		IncludePreexisting:   d.Get("include_preexisting").(bool),
+		IncludeDefaultPrefix: d.Get("include_default_prefix").(bool),
+		DryRun:               d.Get("dry_run").(bool),
+	}
+
+	if !b.tidyLock.TryLock() {
+		return logical.ErrorResponse("a tidy is already running"), nil
+	}
+	defer b.tidyLock.Unlock()
+
+	report, err := b.tidyKeys(ctx, req.Storage, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]map[string]interface{}, 0, len(report.Orphans))
+	for _, orphan := range report.Orphans {
+		orphans = append(orphans, map[string]interface{}{
+			"application_key_id": orphan.ApplicationKeyId,
+			"key_name":           orphan.Name,
+			"connection":         orphan.Connection,
+			"first_seen":         formatTime(orphan.FirstSeen),
+			"preexisting":        orphan.Preexisting,
+		})
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":         opts.DryRun,
+			"orphaned_keys":   orphans,
+			"deleted_keys":    report.Deleted,
+			"expired_records": report.ExpiredRecords,
+		},
+	}
+
+	for _, warning := range report.Warnings {
+		resp.AddWarning(warning)
+	}
+
+	return resp, nil
+}
+
+func (b *backblazeB2Backend) pathAutoTidyConfigRead(ctx context.Context, req *logical.Request, _ *framework.FieldData) (*logical.Response, error) {
+	c, err := b.getAutoTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := b.getTidyState(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"enabled":                c.Enabled,
+			"interval":               c.Interval.Seconds(),
+			"safety_buffer":          c.SafetyBuffer.Seconds(),
+			"include_default_prefix": c.IncludeDefaultPrefix,
+			"last_run":               formatTime(state.LastRun),
+		},
+	}, nil
+}
+
+func (b *backblazeB2Backend) pathAutoTidyConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	c, err := b.getAutoTidyConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := d.GetOk("enabled"); ok {
+		c.Enabled = v.(bool)
+	}
+
+	if v, ok := d.GetOk("interval"); ok {
+		c.Interval = time.Duration(v.(int)) * time.Second
+	}
+
+	if v, ok := d.GetOk("safety_buffer"); ok {
+		c.SafetyBuffer = time.Duration(v.(int)) * time.Second
+	}
+
+	if v, ok := d.GetOk("include_default_prefix"); ok {
+		c.IncludeDefaultPrefix = v.(bool)
+	}
+
+	if c.Interval <= 0 {
+		return logical.ErrorResponse("interval must be positive"), nil
+	}
+
+	if c.SafetyBuffer < minTidySafetyBuffer {
+		return logical.ErrorResponse("safety_buffer must be at least %s", minTidySafetyBuffer), nil
+	}
+
+	entry, err := logical.StorageEntryJSON(autoTidyConfigStoragePath, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// autoTidyIfDue is called periodically and tidies once the configured
+// interval has passed since the last run
+func (b *backblazeB2Backend) autoTidyIfDue(ctx context.Context, s logical.Storage) error {
+	c, err := b.getAutoTidyConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if !c.Enabled {
+		return nil
+	}
+
+	state, err := b.getTidyState(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().Before(state.LastRun.Add(c.Interval)) {
+		return nil
+	}
+
+	// Leave it for the next period if someone is tidying by hand
+	if !b.tidyLock.TryLock() {
+		return nil
+	}
+	defer b.tidyLock.Unlock()
+
+	report, err := b.tidyKeys(ctx, s, tidyOptions{
+		SafetyBuffer:         c.SafetyBuffer,
+		IncludeDefaultPrefix: c.IncludeDefaultPrefix,
+	})
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Info("Tidied orphaned application keys", "orphaned", len(report.Orphans), "deleted", len(report.Deleted), "expired_records", len(report.ExpiredRecords))
+	for _, warning := range report.Warnings {
+		b.Logger().Warn(warning)
+	}
+
+	return nil
+}
+
+// tidyOptions controls what a tidy deletes
+type tidyOptions struct {
+	// SafetyBuffer is how long a key must have been found orphaned
+	// before it is deleted
+	SafetyBuffer time.Duration
+
+	// IncludePreexisting deletes preexisting orphans too
+	IncludePreexisting bool
+
+	// IncludeDefaultPrefix matches keys named with the default key
+	// name prefix, which isn't unique to the mount
+	IncludeDefaultPrefix bool
+
+	DryRun bool
+}
+
+// tidyKeys finds keys in B2 which are named with a role's key name prefix
+// but which the mount doesn't track, and deletes those that have been
+// orphaned for at least the safety buffer. The caller must hold tidyLock.
+func (b *backblazeB2Backend) tidyKeys(ctx context.Context, s logical.Storage, opts tidyOptions) (*tidyReport, error) {
+	report := &tidyReport{}
+
+	prefixes, skipped, err := b.roleKeyNamePrefixes(ctx, s, opts.IncludeDefaultPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(skipped) > 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("skipped roles %s, as their key_name_prefix matches keys named with the default prefix %q, which other mounts may use; set include_default_prefix to tidy them",
+			strings.Join(skipped, ", "), defaultKeyNamePrefix))
+	}
+
+	now := time.Now()
+	tracked, expired, err := b.trackedKeyIDs(ctx, s, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// A record outliving its lease means the lease was lost, so the key
+	// is left for the tidy to find
+	report.ExpiredRecords = expired
+	if !opts.DryRun {
+		for _, id := range expired {
+			b.Logger().Info("Deleting expired issued key record", "id", id)
+			if err := s.Delete(ctx, issuedKeyStoragePrefix+id); err != nil {
+				return nil, fmt.Errorf("error deleting issued key record: %w", err)
+			}
+		}
+	}
+
+	state, err := b.getTidyState(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	firstSeen := make(map[string]time.Time)
+	preexisting := make(map[string]string)
+	listed := make(map[string]bool)
+
+	incomplete := false
+	for _, connection := range slices.Sorted(maps.Keys(prefixes)) {
+		client, err := b.getConnectionClient(ctx, s, connection)
+		if err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("unable to list keys of connection %q: %s", connection, err))
+			incomplete = true
+			continue
+		}
+
+		keys, err := client.ListKeys(ctx)
+		if err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("unable to list keys of connection %q: %s", connection, err))
+			incomplete = true
+			continue
+		}
+
+		firstListing := !state.Listed[connection]
+		listed[connection] = true
+
+		for _, key := range keys {
+			if tracked[key.ID] || !hasAnyPrefix(key.Name, prefixes[connection]) {
+				continue
+			}
+
+			_, wasPreexisting := state.Preexisting[key.ID]
+			orphan := orphanedKey{
+				ApplicationKeyId: key.ID,
+				Name:             key.Name,
+				Connection:       connection,
+				FirstSeen:        now,
+				Preexisting:      firstListing || wasPreexisting,
+			}
+			if seen, ok := state.FirstSeen[key.ID]; ok {
+				orphan.FirstSeen = seen
+			}
+			report.Orphans = append(report.Orphans, orphan)
+			firstSeen[key.ID] = orphan.FirstSeen
+			if orphan.Preexisting {
+				preexisting[key.ID] = connection
+			}
+
+			if (orphan.Preexisting && !opts.IncludePreexisting) || now.Sub(orphan.FirstSeen) < opts.SafetyBuffer {
+				continue
+			}
+
+			if !opts.DryRun {
+				b.Logger().Info("Deleting orphaned application key", "id", key.ID, "name", key.Name, "connection", connection)
+				if err := client.DeleteKey(ctx, key.ID); err != nil {
+					report.Warnings = append(report.Warnings, fmt.Sprintf("unable to delete key %q: %s", key.ID, err))
+					continue
+				}
+				delete(firstSeen, key.ID)
+				delete(preexisting, key.ID)
+			}
+
+			report.Deleted = append(report.Deleted, key.ID)
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	// Keys of connections that couldn't be listed may still be orphans
+	if incomplete {
+		for id, seen := range state.FirstSeen {
+			if _, ok := firstSeen[id]; !ok && !slices.Contains(report.Deleted, id) {
+				firstSeen[id] = seen
+			}
+		}
+	}
+
+	// Preexisting keys of connections that weren't listed are still
+	// preexisting
+	for id, connection := range state.Preexisting {
+		if !listed[connection] {
+			preexisting[id] = connection
+		}
+	}
+
+	if state.Listed == nil {
+		state.Listed = make(map[string]bool)
+	}
+	maps.Copy(state.Listed, listed)
+
+	state.LastRun = now
+	state.FirstSeen = firstSeen
+	state.Preexisting = preexisting
+	if err := b.saveTidyState(ctx, s, state); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// roleKeyNamePrefixes returns the key name prefixes of the roles for each
+// connection. Templated prefixes differ by entity, so only their fixed
+// start is used, and roles without one are left out as their keys can't
+// be told apart from any other. Unless includeDefault is set, roles whose
+// prefix would match every key named with the default prefix are left
+// out too, and returned in skipped.
+func (b *backblazeB2Backend) roleKeyNamePrefixes(ctx context.Context, s logical.Storage, includeDefault bool) (prefixes map[string][]string, skipped []string, err error) {
+	names, err := s.List(ctx, "roles/")
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve list of roles: %w", err)
+	}
+
+	prefixes = make(map[string][]string)
+	for _, name := range names {
+		role, err := b.getRole(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if role == nil {
+			continue
+		}
+
+		prefix, _, _ := strings.Cut(role.KeyNamePrefix, "{{")
+		if prefix == "" {
+			continue
+		}
+
+		if !includeDefault && strings.HasPrefix(defaultKeyNamePrefix, prefix) {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		if !slices.Contains(prefixes[role.Connection], prefix) {
+			prefixes[role.Connection] = append(prefixes[role.Connection], prefix)
+		}
+	}
+
+	return prefixes, skipped, nil
+}
+
+// trackedKeyIDs returns the IDs of every key the mount knows about: keys
+// issued for roles whose leases may still be live, static role and
+// library keys, and the keys of the connections themselves. The IDs of
+// issued keys whose leases have expired by now are returned in expired.
+func (b *backblazeB2Backend) trackedKeyIDs(ctx context.Context, s logical.Storage, now time.Time) (tracked map[string]bool, expired []string, err error) {
+	tracked = make(map[string]bool)
+
+	issued, err := s.List(ctx, issuedKeyStoragePrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve list of issued keys: %w", err)
+	}
+
+	for _, id := range issued {
+		key, err := b.getIssuedKey(ctx, s, id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if key == nil {
+			continue
+		}
+
+		if key.expired(now) {
+			expired = append(expired, id)
+			continue
+		}
+
+		tracked[id] = true
+	}
+
+	staticRoles, err := s.List(ctx, staticRoleStoragePrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve list of static roles: %w", err)
+	}
+
+	for _, name := range staticRoles {
+		r, err := b.getStaticRole(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if r != nil {
+			tracked[r.ApplicationKeyId] = true
+		}
+	}
+
+	sets, err := s.List(ctx, libraryStoragePrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve list of library sets: %w", err)
+	}
+
+	for _, name := range sets {
+		set, err := b.getLibrarySet(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if set == nil {
+			continue
+		}
+
+		for _, key := range set.Keys {
+			tracked[key.ApplicationKeyId] = true
+		}
+	}
+
+	connections, err := s.List(ctx, connectionStoragePrefix)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve list of connections: %w", err)
+	}
+
+	for _, name := range append(connections, defaultConnectionName) {
+		c, err := b.getConnection(ctx, s, name)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if c != nil {
+			tracked[c.ApplicationKeyId] = true
+		}
+	}
+
+	return tracked, expired, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	return slices.ContainsFunc(prefixes, func(prefix string) bool {
+		return strings.HasPrefix(s, prefix)
+	})
+}
+
+func (b *backblazeB2Backend) getAutoTidyConfig(ctx context.Context, s logical.Storage) (*autoTidyConfig, error) {
+	c := &autoTidyConfig{
+		Interval:     defaultAutoTidyInterval,
+		SafetyBuffer: defaultTidySafetyBuffer,
+	}
+
+	entry, err := s.Get(ctx, autoTidyConfigStoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving auto tidy config: %w", err)
+	}
+
+	if entry == nil {
+		return c, nil
+	}
+
+	if err := entry.DecodeJSON(c); err != nil {
+		return nil, fmt.Errorf("error decoding auto tidy config: %w", err)
+	}
+
+	// Configs written before the minimum existed may have a shorter
+	// safety buffer
+	c.SafetyBuffer = max(c.SafetyBuffer, minTidySafetyBuffer)
+
+	return c, nil
+}
+
+func (b *backblazeB2Backend) getTidyState(ctx context.Context, s logical.Storage) (*tidyState, error) {
+	state := &tidyState{}
+
+	entry, err := s.Get(ctx, tidyStateStoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving tidy state: %w", err)
+	}
+
+	if entry == nil {
+		return state, nil
+	}
+
+	if err := entry.DecodeJSON(state); err != nil {
+		return nil, fmt.Errorf("error decoding tidy state: %w", err)
+	}
+
+	return state, nil
+}
+
+func (b *backblazeB2Backend) saveTidyState(ctx context.Context, s logical.Storage, state *tidyState) error {
+	entry, err := logical.StorageEntryJSON(tidyStateStoragePath, state)
+	if err != nil {
+		return fmt.Errorf("failed to create storage entry: %w", err)
+	}
+
+	if err := s.Put(ctx, entry); err != nil {
+		return fmt.Errorf("error saving tidy state: %w", err)
+	}
+
+	return nil
+}
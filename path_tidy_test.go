@@ -0,0 +1,337 @@
+package vault_plugin_secrets_backblazeb2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTidy(t *testing.T) {
+	ctx := context.Background()
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities": testApplicationKeyCapabilities,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	// Keys the mount knows about, all named with the role's prefix
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + testRoleName,
+		Storage:   s,
+	})
+	require.NoError(t, err)
+	secret := resp.Secret
+	issuedID := resp.Data["application_key_id"].(string)
+
+	resp, err = testStaticRoleWrite(b, s, testStaticRoleName, map[string]interface{}{
+		"capabilities":    testApplicationKeyCapabilities,
+		"key_name":        "vault-static",
+		"rotation_period": "1h",
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	resp, err = testLibraryWrite(b, s, testLibrarySetName, map[string]interface{}{
+		"capabilities": testApplicationKeyCapabilities,
+	})
+	require.NoError(t, err)
+	require.False(t, resp.IsError())
+
+	// A key from before the first tidy, which may have been issued
+	// before the mount kept records of keys
+	preexisting, err := fake.addKey("vault-preexisting", b2KeyOptions{Capabilities: testApplicationKeyCapabilities})
+	require.NoError(t, err)
+
+	tidyWith := func(t *testing.T, d map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "tidy",
+			Storage:   s,
+			Data:      d,
+		})
+		require.NoError(t, err)
+		require.False(t, resp.IsError())
+
+		return resp
+	}
+
+	// The role uses the default key name prefix, so the rest of the
+	// tidies opt in to matching it
+	tidy := func(t *testing.T, d map[string]interface{}) *logical.Response {
+		data := map[string]interface{}{"include_default_prefix": true}
+		for k, v := range d {
+			data[k] = v
+		}
+
+		return tidyWith(t, data)
+	}
+
+	orphanIDs := func(resp *logical.Response) []string {
+		var ids []string
+		for _, orphan := range resp.Data["orphaned_keys"].([]map[string]interface{}) {
+			ids = append(ids, orphan["application_key_id"].(string))
+		}
+		return ids
+	}
+
+	t.Run("Default prefix", func(t *testing.T) {
+		resp := tidyWith(t, nil)
+		require.Empty(t, resp.Data["orphaned_keys"])
+		require.Len(t, resp.Warnings, 1)
+		require.Contains(t, resp.Warnings[0], testRoleName)
+		require.NotNil(t, fake.key(preexisting.ID))
+
+		// Nothing was listed, so the first listing is still to come
+		state, err := b.getTidyState(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, state.Listed)
+	})
+
+	t.Run("Safety buffer too short", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "tidy",
+			Storage:   s,
+			Data:      map[string]interface{}{"safety_buffer": "1m"},
+		})
+		require.NoError(t, err)
+		require.True(t, resp.IsError())
+	})
+
+	t.Run("First listing", func(t *testing.T) {
+		resp := tidy(t, map[string]interface{}{"dry_run": true})
+		require.Equal(t, []string{preexisting.ID}, orphanIDs(resp))
+		require.Equal(t, true, resp.Data["orphaned_keys"].([]map[string]interface{})[0]["preexisting"])
+		require.Empty(t, resp.Data["deleted_keys"])
+
+		resp = tidy(t, nil)
+		require.Equal(t, []string{preexisting.ID}, orphanIDs(resp))
+		require.Empty(t, resp.Data["deleted_keys"])
+		require.NotNil(t, fake.key(preexisting.ID))
+	})
+
+	// Keys the mount doesn't know about
+	orphan, err := fake.addKey("vault-orphan", b2KeyOptions{Capabilities: testApplicationKeyCapabilities})
+	require.NoError(t, err)
+	unrelated, err := fake.addKey("backup-server", b2KeyOptions{Capabilities: testApplicationKeyCapabilities})
+	require.NoError(t, err)
+
+	keys := len(fake.keys)
+
+	t.Run("Within safety buffer", func(t *testing.T) {
+		resp := tidy(t, nil)
+		require.ElementsMatch(t, []string{preexisting.ID, orphan.ID}, orphanIDs(resp))
+		require.Empty(t, resp.Data["deleted_keys"])
+		require.NotNil(t, fake.key(orphan.ID))
+
+		state, err := b.getTidyState(ctx, s)
+		require.NoError(t, err)
+		require.Contains(t, state.FirstSeen, orphan.ID)
+	})
+
+	ageTidyState(t, b, s, defaultTidySafetyBuffer)
+
+	t.Run("Dry run", func(t *testing.T) {
+		resp := tidy(t, map[string]interface{}{"dry_run": true})
+		require.ElementsMatch(t, []string{preexisting.ID, orphan.ID}, orphanIDs(resp))
+		require.Equal(t, []string{orphan.ID}, resp.Data["deleted_keys"])
+		require.Len(t, fake.keys, keys)
+	})
+
+	t.Run("B2 failure", func(t *testing.T) {
+		fake.deleteErr = errors.New("simulated B2 failure")
+		defer func() { fake.deleteErr = nil }()
+
+		resp := tidy(t, nil)
+		require.Empty(t, resp.Data["deleted_keys"])
+		require.Len(t, resp.Warnings, 1)
+		require.NotNil(t, fake.key(orphan.ID))
+	})
+
+	t.Run("Delete orphans", func(t *testing.T) {
+		resp := tidy(t, nil)
+		require.Equal(t, []string{orphan.ID}, resp.Data["deleted_keys"])
+		require.Nil(t, fake.key(orphan.ID))
+		require.NotNil(t, fake.key(unrelated.ID))
+		require.NotNil(t, fake.key(issuedID))
+		require.NotNil(t, fake.key(preexisting.ID))
+		require.Len(t, fake.keys, keys-1)
+
+		state, err := b.getTidyState(ctx, s)
+		require.NoError(t, err)
+		require.NotContains(t, state.FirstSeen, orphan.ID)
+		require.Contains(t, state.Preexisting, preexisting.ID)
+	})
+
+	t.Run("Include preexisting", func(t *testing.T) {
+		resp := tidy(t, map[string]interface{}{"include_preexisting": true})
+		require.Equal(t, []string{preexisting.ID}, resp.Data["deleted_keys"])
+		require.Nil(t, fake.key(preexisting.ID))
+
+		state, err := b.getTidyState(ctx, s)
+		require.NoError(t, err)
+		require.Empty(t, state.FirstSeen)
+		require.Empty(t, state.Preexisting)
+	})
+
+	t.Run("Expired record", func(t *testing.T) {
+		// The lease was lost, and can't have outlived its max TTL
+		lost, err := fake.addKey("vault-lost", b2KeyOptions{Capabilities: testApplicationKeyCapabilities})
+		require.NoError(t, err)
+		require.NoError(t, b.saveIssuedKey(ctx, s, lost.ID, &issuedKey{
+			Role:       testRoleName,
+			KeyName:    lost.Name,
+			CreateTime: time.Now().Add(-2 * time.Hour),
+			ExpireTime: time.Now().Add(-time.Hour),
+		}))
+
+		resp := tidy(t, map[string]interface{}{"dry_run": true})
+		require.Equal(t, []string{lost.ID}, resp.Data["expired_records"])
+		require.Equal(t, []string{lost.ID}, orphanIDs(resp))
+
+		key, err := b.getIssuedKey(ctx, s, lost.ID)
+		require.NoError(t, err)
+		require.NotNil(t, key)
+
+		resp = tidy(t, nil)
+		require.Equal(t, []string{lost.ID}, resp.Data["expired_records"])
+		require.Equal(t, []string{lost.ID}, orphanIDs(resp))
+		require.Empty(t, resp.Data["deleted_keys"])
+		require.NotNil(t, fake.key(lost.ID))
+
+		key, err = b.getIssuedKey(ctx, s, lost.ID)
+		require.NoError(t, err)
+		require.Nil(t, key)
+
+		// Deleted like any other orphan once past the safety buffer
+		ageTidyState(t, b, s, defaultTidySafetyBuffer)
+
+		resp = tidy(t, nil)
+		require.Empty(t, resp.Data["expired_records"])
+		require.Equal(t, []string{lost.ID}, resp.Data["deleted_keys"])
+		require.Nil(t, fake.key(lost.ID))
+	})
+
+	t.Run("Revoke removes the record", func(t *testing.T) {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   s,
+			Secret:    secret,
+		})
+		require.NoError(t, err)
+
+		entry, err := s.Get(ctx, issuedKeyStoragePrefix+issuedID)
+		require.NoError(t, err)
+		require.Nil(t, entry)
+	})
+}
+
+func TestAutoTidy(t *testing.T) {
+	ctx := context.Background()
+	b, s, fake := getTestBackendWithFakeB2(t)
+
+	resp, err := testTokenRoleCreate(t, b, s, testRoleName, map[string]interface{}{
+		"capabilities":    testApplicationKeyCapabilities,
+		"key_name_prefix": "vault-{{identity.entity.name}}-",
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp)
+
+	orphan, err := fake.addKey("vault-alice-orphan", b2KeyOptions{Capabilities: testApplicationKeyCapabilities})
+	require.NoError(t, err)
+
+	writeConfig := func(t *testing.T, d map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config/auto-tidy",
+			Storage:   s,
+			Data:      d,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	readConfig := func(t *testing.T) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "config/auto-tidy",
+			Storage:   s,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp = readConfig(t)
+	require.Equal(t, false, resp.Data["enabled"])
+	require.Equal(t, defaultAutoTidyInterval.Seconds(), resp.Data["interval"])
+	require.Equal(t, defaultTidySafetyBuffer.Seconds(), resp.Data["safety_buffer"])
+	require.Equal(t, false, resp.Data["include_default_prefix"])
+
+	// Disabled by default
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.NotNil(t, fake.key(orphan.ID))
+
+	resp = writeConfig(t, map[string]interface{}{"interval": 0})
+	require.True(t, resp.IsError())
+
+	// The role's prefix starts with the default one
+	resp = writeConfig(t, map[string]interface{}{"safety_buffer": "1m"})
+	require.True(t, resp.IsError())
+
+	// The role's prefix starts with the default one
+	resp = writeConfig(t, map[string]interface{}{"enabled": true, "include_default_prefix": true})
+	require.Nil(t, resp)
+
+	// Found on the first listing, so it may still have a lease
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.NotNil(t, fake.key(orphan.ID))
+	preexisting := orphan
+
+	resp = readConfig(t)
+	require.NotEmpty(t, resp.Data["last_run"])
+
+	// Not due again until the interval has passed
+	orphan, err = fake.addKey("vault-bob-orphan", b2KeyOptions{Capabilities: testApplicationKeyCapabilities})
+	require.NoError(t, err)
+
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.NotNil(t, fake.key(orphan.ID))
+
+	state, err := b.getTidyState(ctx, s)
+	require.NoError(t, err)
+	require.NotContains(t, state.FirstSeen, orphan.ID)
+
+	// Found once the interval has passed, and deleted by the first run
+	// after the safety buffer
+	ageTidyState(t, b, s, defaultAutoTidyInterval)
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.NotNil(t, fake.key(orphan.ID))
+
+	ageTidyState(t, b, s, defaultAutoTidyInterval)
+	require.NoError(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	require.Nil(t, fake.key(orphan.ID))
+	require.NotNil(t, fake.key(preexisting.ID))
+}
+
+// ageTidyState moves the last tidy, and when each orphan was first seen,
+// back by d
+func ageTidyState(t *testing.T, b *backblazeB2Backend, s logical.Storage, d time.Duration) {
+	t.Helper()
+
+	state, err := b.getTidyState(context.Background(), s)
+	require.NoError(t, err)
+
+	state.LastRun = state.LastRun.Add(-d)
+	for id, seen := range state.FirstSeen {
+		state.FirstSeen[id] = seen.Add(-d)
+	}
+
+	require.NoError(t, b.saveTidyState(context.Background(), s, state))
+}